@@ -2,8 +2,14 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 )
 
 // os.Args splits by space
@@ -13,12 +19,159 @@ type argPair struct {
 	Val string
 }
 
+// parsedArgs holds everything found in the command line args
+type parsedArgs struct {
+	pairs []argPair
+	// command is the leading subcommand, if it is one of Commands
+	command string
+	// positionals are the args that are neither flags nor flag values
+	positionals []string
+	// errs are the @file args that could not be expanded
+	errs []error
+}
+
+// InferFlagTypes makes numeric flag values ints or floats instead of
+// strings, e.g. --port=8080 sets the int 8080. Values with leading zeros,
+// like 0755, stay strings
+var InferFlagTypes = false
+
+var (
+	intPattern   = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)$`)
+	floatPattern = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)?\.[0-9]+([eE][-+]?[0-9]+)?$`)
+)
+
+var (
+	commands      = make(map[string]bool)
+	commandsMutex = &sync.Mutex{}
+)
+
+// Commands declares the subcommands of the program. A leading positional
+// arg naming one of them is the command, available as Get("command"),
+// e.g. `prog migrate --migrate:dry-run`
+func Commands(names ...string) {
+	commandsMutex.Lock()
+	for _, name := range names {
+		commands[strings.ToLower(name)] = true
+	}
+	commandsMutex.Unlock()
+}
+
+func isCommand(name string) bool {
+	commandsMutex.Lock()
+	defer commandsMutex.Unlock()
+	return commands[strings.ToLower(name)]
+}
+
+// resetCommands forgets all declared subcommands
+func resetCommands() {
+	commandsMutex.Lock()
+	commands = make(map[string]bool)
+	commandsMutex.Unlock()
+}
+
+// Args returns the positional command line args: those that are neither
+// flags, flag values nor the subcommand. Everything after `--` is
+// positional
+func Args() []string {
+	return parseArgs(commandLineArgs()).positionals
+}
+
 func loadCommandLineArgs() {
-	pairs := parseCommandLineArgs()
-	for _, p := range pairs {
+	parsed := parseArgs(commandLineArgs())
+	for _, err := range parsed.errs {
+		addWarning(err)
+	}
+	if parsed.command != "" {
+		Set("command", parsed.command)
+		setPosition("command", Position{Source: "command line"})
+	}
+	// counted short flags, e.g. -vvv
+	counts := make(map[string]int)
+	var counted []string
+
+	for _, p := range parsed.pairs {
 		key, _ := stripConfigPrefix(p.Key)
-		Set(key, p.Val)
+		if short, ok := lookupShortFlag(key); ok && short.count && p.Val == "true" {
+			if counts[short.key] == 0 {
+				counted = append(counted, short.key)
+			}
+			counts[short.key]++
+			continue
+		}
+		key = optionForFlag(key)
+		Set(key, argValue(p.Val))
+		setPosition(normalizeKey(key), Position{Source: flagName(p.Key)})
 	}
+
+	for _, key := range counted {
+		Set(key, counts[key])
+		setPosition(key, Position{Source: "counted flag"})
+	}
+}
+
+// flagName formats a flag as given on the command line, e.g. -p or --port
+func flagName(name string) string {
+	if utf8.RuneCountInString(name) == 1 {
+		return "flag -" + name
+	}
+	return "flag --" + name
+}
+
+// argValue types the value of a flag: true and false become bools, and
+// numbers become ints and floats with InferFlagTypes
+func argValue(val string) interface{} {
+	switch strings.ToLower(val) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if !InferFlagTypes {
+		return val
+	}
+	if intPattern.MatchString(val) {
+		if n, err := strconv.Atoi(val); err == nil {
+			return n
+		}
+	}
+	if floatPattern.MatchString(val) {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return f
+		}
+	}
+	return val
+}
+
+// negatedKey returns the key turned off by a --no-<key> flag. Declared
+// options and aliases starting with no- are not negations
+func negatedKey(name string) (string, bool) {
+	lower := strings.ToLower(name)
+	if !strings.HasPrefix(lower, "no-") || len(lower) == len("no-") {
+		return "", false
+	}
+	if _, ok := lookupOption(lower); ok || optionForFlag(lower) != lower {
+		return "", false
+	}
+	return name[len("no-"):], true
+}
+
+// isSwitch reports whether a flag never takes a value: counted short
+// flags, flags of bool options and bound bool flags
+func isSwitch(name string) bool {
+	key, _ := stripConfigPrefix(name)
+	if short, ok := lookupShortFlag(key); ok && short.count {
+		return true
+	}
+	if option, ok := lookupOption(optionForFlag(key)); ok {
+		_, isBool := option.Default.(bool)
+		return isBool
+	}
+	for _, f := range boundFlags() {
+		if f.name == name {
+			return f.isBool
+		}
+	}
+	return false
 }
 
 // parseCommandLineArgs parses all the os.Args into key-value pairs
@@ -29,111 +182,287 @@ func loadCommandLineArgs() {
 //   -klm  (Stacked short flags. Each set to true)
 //   -klm value (k and l set to true, m set to value)
 //   --key (flag `key` set to true)
+//   --no-key (flag `key` set to false)
 //   --key value
+//   --key -1 (negative numbers are values, not flags)
 //   --key=value
+//   --key="quoted value"
+//   @file (args read from file, see splitArgsFile)
+//   -- (the remaining args are positional)
 // All keys will be lower-cased
 func parseCommandLineArgs() []argPair {
+	return parseArgs(commandLineArgs()).pairs
+}
 
-	// We use a referenceable list of pairs during
-	// our pair construction. At the end, we'll
-	// convert to values
-	var pairs []*argPair
-	lastKeyUsedZeroValue := false
+// commandLineArgs returns the args (minus the program name) meant for
+// config, leaving out flags handled by bound flag sets
+func commandLineArgs() []string {
+	if len(os.Args) < 2 {
+		return nil
+	}
+	return withoutBoundFlags(os.Args[1:])
+}
+
+// parseArgs expands @file args, then parses the args into key-value
+// pairs, see parseCommandLineArgs, and collects the subcommand and
+// positional args
+func parseArgs(args []string) parsedArgs {
+	expanded, errs := expandArgsFiles(args, nil)
+	parsed := parseArgList(expanded)
+	parsed.errs = errs
+	return parsed
+}
+
+// parseArgList parses args without expanding @file args. It never fails:
+// malformed flags, like -=x, are skipped
+func parseArgList(args []string) parsedArgs {
+
+	var parsed parsedArgs
+
+	// index of the last flag, while it may still take the next arg as
+	// its value
+	pending := -1
 
 	// Every arg in the command line is positional until we reach an option or
 	// flag
 	doneWithPositionalArgs := false
 
-	// Run through all the args (minus the program name)
-	for _, arg := range os.Args[1:] {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		switch {
 
-		// The general strategy is to create a pair from
-		// an arg if we can (e.g. contains an equal rune)
-		// but if the arg is indefinite, we just set the
-		// value of the pair to empty string.
+		// a value for the last flag, if it is still waiting for one.
+		// Negative numbers are values, not short flags
+		case pending >= 0 && (!strings.HasPrefix(arg, "-") || isNegativeNumber(arg)):
+			parsed.pairs[pending].Val = unquote(arg)
+			pending = -1
 
-		// If we have an arg without a hypen, we'll do
-		// a look-back and use the arg to set the value
-		// of the last pair (if it has an empty string val)
+		// end of options, everything else is positional
+		case arg == "--":
+			parsed.positionals = append(parsed.positionals, args[i+1:]...)
+			i = len(args)
 
-		// if --
-		if strings.HasPrefix(arg, "--") {
+		// long flags: --key, --key=value, --no-key
+		case strings.HasPrefix(arg, "--"):
 			doneWithPositionalArgs = true
-			rawArg := strings.TrimPrefix(arg, "--")
-			// if include =, split into key/val
-			parts := strings.SplitN(rawArg, "=", 2)
-			if len(parts) == 1 {
-				lastKeyUsedZeroValue = true
-				newPair := &argPair{rawArg, ""}
-				pairs = append(pairs, newPair)
-			} else {
-				lastKeyUsedZeroValue = false
-				newPair := &argPair{parts[0], parts[1]}
-				pairs = append(pairs, newPair)
+			pending = -1
+			parts := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)
+			if parts[0] == "" {
+				continue
+			}
+			if len(parts) == 2 {
+				parsed.pairs = append(parsed.pairs, argPair{parts[0], unquote(parts[1])})
+				continue
+			}
+			if key, ok := negatedKey(parts[0]); ok {
+				parsed.pairs = append(parsed.pairs, argPair{key, "false"})
+				continue
+			}
+			parsed.pairs = append(parsed.pairs, argPair{parts[0], ""})
+			if !isSwitch(parts[0]) {
+				pending = len(parsed.pairs) - 1
 			}
 
-		} else if strings.HasPrefix(arg, "-") {
+		// Short flags
+		// Single hyphens behave a bit differently as they
+		// can "stack" as boolean values. If you put several
+		// together, like -abc then all then a and b should
+		// be set to true, and c should be left indefinite.
+		// A lone - is positional (often standing for stdin)
+		case strings.HasPrefix(arg, "-") && arg != "-":
 			doneWithPositionalArgs = true
-			// Short flags
-			// Single hyphens behave a bit differently as they
-			// can "stack" as boolean values. If you put several
-			// together, like -abc then all then a and b should
-			// be set to true, and c should be left indefinite
-			rawArg := strings.TrimPrefix(arg, "-")
-
-			// strip off anything after an equal rune, to set
-			// on the last short flag
-			parts := strings.SplitN(rawArg, "=", 2)
-			rawArg = parts[0]
-
-			// make pair for each short flag and
-			for _, c := range rawArg {
-
+			pending = -1
+			parts := strings.SplitN(strings.TrimPrefix(arg, "-"), "=", 2)
+			added := 0
+			for _, c := range parts[0] {
 				// if we get another hypen, just ignore it
-				if c == rune('-') {
+				if c == '-' {
 					continue
 				}
-
-				// Set all short flags to "1"/true.
-				// If there was an argument, we'll overwrite
-				// the value for the last flag
-				val := "1"
-				lastKeyUsedZeroValue = true
-				newPair := &argPair{fmt.Sprintf("%c", c), val}
-				pairs = append(pairs, newPair)
+				parsed.pairs = append(parsed.pairs, argPair{string(c), ""})
+				added++
+			}
+			// the last short flag gets the value
+			if added == 0 {
+				continue
+			}
+			last := len(parsed.pairs) - 1
+			if len(parts) == 2 {
+				parsed.pairs[last].Val = unquote(parts[1])
+			} else if !isSwitch(parsed.pairs[last].Key) {
+				pending = last
 			}
 
-			// Now handle the equal rune (a value set on the short flag)
-			// Set the last pair to the value
-			if len(parts) > 1 {
-				pairs[len(pairs)-1].Val = parts[1]
+		// Leading positional args, the first of which may be the
+		// subcommand
+		case !doneWithPositionalArgs:
+			if len(parsed.positionals) == 0 && parsed.command == "" && isCommand(arg) {
+				parsed.command = strings.ToLower(arg)
+			} else {
+				parsed.positionals = append(parsed.positionals, arg)
 			}
 
-		} else {
+		default:
+			parsed.positionals = append(parsed.positionals, arg)
+		}
+	}
 
-			// for the purposes of config, just skip over positional args
-			if !doneWithPositionalArgs {
-				continue
-			}
+	// Any remaining unassigned values should be set to true, and all keys
+	// lower-cased
+	for i := range parsed.pairs {
+		parsed.pairs[i].Key = strings.ToLower(parsed.pairs[i].Key)
+		if parsed.pairs[i].Val == "" {
+			parsed.pairs[i].Val = "true"
+		}
+	}
+	return parsed
+}
 
-			// This is a value, not a flag (since it doesn't start with a hyphen)
-			// Set as val of prev pair, if the pair value is empty
-			last := pairs[len(pairs)-1]
-			if lastKeyUsedZeroValue {
-				last.Val = arg
-			}
+// isNegativeNumber reports whether an arg is a number like -1 or -0.5
+func isNegativeNumber(arg string) bool {
+	if !strings.HasPrefix(arg, "-") {
+		return false
+	}
+	_, err := strconv.ParseFloat(arg, 64)
+	return err == nil && (intPattern.MatchString(arg) || floatPattern.MatchString(arg))
+}
+
+// unquote removes one pair of matching surrounding quotes from a value,
+// e.g. --name="a b" as passed by launchers that don't strip quotes
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// maxArgsFileDepth limits how deeply @file args may include each other
+const maxArgsFileDepth = 10
+
+// expandArgsFiles replaces @file args with the args read from the file.
+// Args files may contain @file args too. Files that can't be read are
+// reported and their arg is kept as is. @@value stands for a literal
+// @value
+func expandArgsFiles(args []string, seen []string) ([]string, []error) {
+	var (
+		expanded []string
+		errs     []error
+	)
+	for i, arg := range args {
+		if arg == "--" {
+			return append(expanded, args[i:]...), errs
+		}
+		if strings.HasPrefix(arg, "@@") {
+			expanded = append(expanded, arg[1:])
+			continue
+		}
+		if !strings.HasPrefix(arg, "@") || len(arg) == 1 {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		path := arg[1:]
+		fileArgs, err := readArgsFile(path, seen)
+		if err != nil {
+			errs = append(errs, err)
+			expanded = append(expanded, arg)
+			continue
+		}
+		nested, nestedErrs := expandArgsFiles(fileArgs, append(seen, path))
+		expanded = append(expanded, nested...)
+		errs = append(errs, nestedErrs...)
+	}
+	return expanded, errs
+}
+
+// readArgsFile reads the args in an args file, refusing include cycles
+func readArgsFile(path string, seen []string) ([]string, error) {
+	if len(seen) >= maxArgsFileDepth {
+		return nil, fmt.Errorf("args file %s: nested too deeply", path)
+	}
+	for _, included := range seen {
+		if included == path {
+			return nil, fmt.Errorf("args file %s: includes itself", path)
 		}
 	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("args file %s: %v", path, err)
+	}
+	args, err := splitArgsFile(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("args file %s: %v", path, err)
+	}
+	return args, nil
+}
+
+// splitArgsFile splits the contents of an args file into args. Args are
+// separated by whitespace, and may be quoted: '...' is taken literally,
+// while "..." allows \" and \\ escapes. Outside quotes, a backslash
+// escapes the next character. Lines starting with # are comments
+func splitArgsFile(content string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+		comment bool
+	)
 
-	// Package up for return value
-	var returnPairs []argPair
-	for _, p := range pairs {
-		p.Key = strings.ToLower(p.Key)
-		// Any remaining unassigned values should be set to "1" (true)
-		if p.Val == "" {
-			p.Val = "1"
+	for _, c := range content {
+		switch {
+		case comment:
+			if c == '\n' {
+				comment = false
+			}
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case quote == '"':
+			switch c {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				current.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case unicode.IsSpace(c):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		case c == '#' && !inArg:
+			comment = true
+		default:
+			current.WriteRune(c)
+			inArg = true
 		}
-		returnPairs = append(returnPairs, *p)
 	}
-	return returnPairs
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
 }
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnitParseArgs(t *testing.T) {
+
+	var argsTests = []struct {
+		name        string
+		argsIn      []string
+		pairs       []argPair
+		positionals []string
+	}{
+		{"positional after valued flag", []string{"--a=1", "b", "c"}, []argPair{{"a", "1"}}, []string{"b", "c"}},
+		{"leading -=", []string{"-=x"}, nil, nil},
+		{"empty long flag", []string{"--=x", "y"}, nil, []string{"y"}},
+		{"negative number value", []string{"--offset", "-1", "--ratio", "-0.5"}, []argPair{{"offset", "-1"}, {"ratio", "-0.5"}}, nil},
+		{"flag after bare flag", []string{"--a", "-b"}, []argPair{{"a", "true"}, {"b", "true"}}, nil},
+		{"double quoted value", []string{`--name="a b"`}, []argPair{{"name", "a b"}}, nil},
+		{"single quoted value", []string{"--name", "'a b'"}, []argPair{{"name", "a b"}}, nil},
+		{"short flag value", []string{"-ab=\"x\"", "y"}, []argPair{{"a", "true"}, {"b", "x"}}, []string{"y"}},
+		{"lone dash", []string{"--a=1", "-"}, []argPair{{"a", "1"}}, []string{"-"}},
+		{"hyphens only", []string{"---", "----=x"}, []argPair{{"-", "true"}, {"--", "x"}}, nil},
+	}
+
+	for _, tt := range argsTests {
+		parsed := parseArgs(tt.argsIn)
+		if !reflect.DeepEqual(parsed.pairs, tt.pairs) {
+			t.Errorf("%s: expected pairs %v, got %v", tt.name, tt.pairs, parsed.pairs)
+		}
+		if !reflect.DeepEqual(parsed.positionals, tt.positionals) {
+			t.Errorf("%s: expected positionals %v, got %v", tt.name, tt.positionals, parsed.positionals)
+		}
+	}
+}
+
+func TestUnitArgsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-args")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	nested := filepath.Join(dir, "nested.args")
+	main := filepath.Join(dir, "main.args")
+	loop := filepath.Join(dir, "loop.args")
+	ioutil.WriteFile(nested, []byte("--b=2\n"), 0600)
+	ioutil.WriteFile(main, []byte("# service flags\n--name 'my service' --path=\"C:\\\\tmp\"\n@"+nested+"\n"), 0600)
+	ioutil.WriteFile(loop, []byte("@"+loop), 0600)
+
+	parsed := parseArgs([]string{"--a=1", "@" + main, "@@literal", "@" + loop})
+
+	expected := []argPair{{"a", "1"}, {"name", "my service"}, {"path", `C:\tmp`}, {"b", "2"}}
+	if !reflect.DeepEqual(parsed.pairs, expected) {
+		t.Errorf("expected pairs %v, got %v", expected, parsed.pairs)
+	}
+	if !reflect.DeepEqual(parsed.positionals, []string{"@literal", "@" + loop}) {
+		t.Errorf("unexpected positionals %v", parsed.positionals)
+	}
+	if len(parsed.errs) != 1 || !strings.Contains(parsed.errs[0].Error(), "includes itself") {
+		t.Errorf("expected an include cycle error, got %v", parsed.errs)
+	}
+
+	if _, err := splitArgsFile(`--a "unterminated`); err == nil {
+		t.Errorf("expected an error for an unterminated quote")
+	}
+}
+
+// FuzzParseArgs checks that no command line makes the parser panic. Args
+// are separated by NUL bytes
+func FuzzParseArgs(f *testing.F) {
+	seeds := []string{
+		"--a=1\x00b\x00c",
+		"-=x",
+		"--\x00-a",
+		"-abc=\x00--d\x00w",
+		"--no-\x00--no-x",
+		"---\x00-\x00--=",
+		"--k\x00-1\x00-\x00'q'",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		parsed := parseArgList(strings.Split(input, "\x00"))
+		for _, pair := range parsed.pairs {
+			if pair.Key != strings.ToLower(pair.Key) {
+				t.Errorf("key %q is not lower-cased", pair.Key)
+			}
+			if pair.Key == "" || pair.Val == "" {
+				t.Errorf("incomplete pair %v", pair)
+			}
+		}
+	})
+}
+
+// FuzzSplitArgsFile checks that no args file makes the tokenizer panic
+func FuzzSplitArgsFile(f *testing.F) {
+	seeds := []string{
+		"--a 1\n# comment\n--b='x y'",
+		`--c "a \" b" \\`,
+		"'unterminated",
+		"\"\\",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		splitArgsFile(input)
+	})
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CacheDir is the directory where successfully fetched remote config
+// documents are kept. If a remote source cannot be reached later on, the
+// cached copy is used instead. Caching is off when CacheDir is empty and
+// the CONFIG_CACHE_DIR env variable is not set
+var CacheDir = ""
+
+// StaleSourceError is recorded as a warning when a remote source could not
+// be fetched and its last known good copy was loaded from the cache
+type StaleSourceError struct {
+	URI       string
+	FetchedAt time.Time
+	Err       error
+}
+
+func (e *StaleSourceError) Error() string {
+	return fmt.Sprintf(
+		"config source %s is unreachable (%v), using cached copy fetched at %s",
+		e.URI, e.Err, e.FetchedAt.Format(time.RFC3339),
+	)
+}
+
+func (e *StaleSourceError) Unwrap() error {
+	return e.Err
+}
+
+// cacheEntry describes a cached document
+type cacheEntry struct {
+	URI       string    `json:"uri"`
+	Checksum  string    `json:"checksum"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// cacheDir returns the configured cache directory, if any
+func cacheDir() string {
+	if CacheDir != "" {
+		return CacheDir
+	}
+	return os.Getenv("CONFIG_CACHE_DIR")
+}
+
+// fetch loads a config source. Remote sources are stored in the cache
+// after every successful fetch, and served from it when the fetch fails.
+// Sources failing signature verification are rejected, not served from
+// the cache
+func fetch(ctx context.Context, uri string, loader ContextLoader) ([]byte, error) {
+
+	dir := cacheDir()
+	if dir == "" || LoaderType(uri) == "file" {
+		return loader.LoadContext(ctx)
+	}
+
+	data, err := loader.LoadContext(ctx)
+	if err == nil {
+		if cacheErr := writeCache(dir, uri, data); cacheErr != nil {
+			addWarning(fmt.Errorf("could not cache config source %s: %v", uri, cacheErr))
+		}
+		return data, nil
+	}
+
+	var sigErr *SignatureError
+	if errors.As(err, &sigErr) {
+		return nil, err
+	}
+
+	cached, entry, cacheErr := readCache(dir, uri)
+	if cacheErr != nil {
+		return nil, err
+	}
+
+	addWarning(&StaleSourceError{URI: uri, FetchedAt: entry.FetchedAt, Err: err})
+	return cached, nil
+}
+
+// cachePaths returns the document and metadata paths for a source. The
+// timeout parameter is ignored so that changing it keeps the cache, other
+// parameters, e.g. ?version=2 of an http source, name other documents
+func cachePaths(dir, uri string) (string, string) {
+	sum := sha256.Sum256([]byte(withoutTimeout(uri)))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(dir, name+".yaml"), filepath.Join(dir, name+".json")
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeCache stores a fetched document together with its checksum and
+// fetch time
+func writeCache(dir, uri string, data []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	entry := cacheEntry{
+		URI:       uri,
+		Checksum:  checksum(data),
+		FetchedAt: time.Now().UTC(),
+	}
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	docPath, metaPath := cachePaths(dir, uri)
+	if err := writeFileAtomic(docPath, data); err != nil {
+		return err
+	}
+	return writeFileAtomic(metaPath, meta)
+}
+
+// readCache returns a cached document, provided it still matches its
+// recorded checksum
+func readCache(dir, uri string) ([]byte, *cacheEntry, error) {
+	docPath, metaPath := cachePaths(dir, uri)
+
+	meta, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(meta, &entry); err != nil {
+		return nil, nil, err
+	}
+
+	data, err := ioutil.ReadFile(docPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if checksum(data) != entry.Checksum {
+		return nil, nil, errors.New("cached config does not match its checksum")
+	}
+
+	return data, &entry, nil
+}
+
+// writeFileAtomic writes through a temporary file so readers never see a
+// partially written document
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
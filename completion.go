@@ -0,0 +1,239 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// CompletionScript returns a bash, zsh or fish script completing the
+// flags of prog: every key of the config tree (as loaded), of the declared
+// options and of the last validated schema, as --key and --key:sub. Values
+// of enum and bool keys are completed after the `=`
+func CompletionScript(shell, prog string) (string, error) {
+	keys, values := completionKeys()
+	switch shell {
+	case "bash":
+		return bashCompletion(prog, keys, values), nil
+	case "zsh":
+		return zshCompletion(prog, keys, values), nil
+	case "fish":
+		return fishCompletion(prog, keys, values), nil
+	}
+	return "", fmt.Errorf("unsupported shell %q: expected bash, zsh or fish", shell)
+}
+
+// printCompletion prints the completion script requested with
+// --completion. It only needs the keys of the config sources, so it runs
+// before anything that could fail on an incomplete config, like missing
+// secrets or required options
+func printCompletion(ctx context.Context, shell string) error {
+	if schemaURI := os.Getenv("CONFIG_SCHEMA"); schemaURI != "" {
+		if err := declareSchemaURI(ctx, schemaURI); err != nil {
+			addWarning(err)
+		}
+	}
+	script, err := CompletionScript(shell, filepath.Base(os.Args[0]))
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(HelpOutput, script)
+	return ErrHelp
+}
+
+// completionRequested returns the shell passed with --completion, if any
+func completionRequested() string {
+	if len(Options()) == 0 {
+		return ""
+	}
+	for _, pair := range parseCommandLineArgs() {
+		if pair.Key == "completion" {
+			return pair.Val
+		}
+	}
+	return ""
+}
+
+// completionKeys returns the sorted keys to complete, and the known values
+// of some of them
+func completionKeys() ([]string, map[string][]string) {
+	known := make(map[string]bool)
+	values := make(map[string][]string)
+
+	tree := make(map[string]bool)
+	collectKeys(config, "", tree)
+	for k := range tree {
+		known[stripOverlay(k)] = true
+	}
+
+	collectSchemaKeys(getDeclaredSchema(), "", known, values)
+
+	for _, option := range Options() {
+		for _, node := range parentKeys(option.Key) {
+			known[node] = true
+		}
+		if len(option.Enum) > 0 {
+			values[option.Key] = option.Enum
+		} else if _, ok := option.Default.(bool); ok {
+			values[option.Key] = []string{"true", "false"}
+		}
+	}
+
+	var keys []string
+	for k := range known {
+		if !reservedKeys[strings.SplitN(k, ":", 2)[0]] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, values
+}
+
+// collectSchemaKeys adds the properties of a schema, and their enums
+func collectSchemaKeys(schema map[string]interface{}, path string, keys map[string]bool, values map[string][]string) {
+	properties, _ := schema["properties"].(map[string]interface{})
+	for name, propSchema := range properties {
+		keyPath := joinKeyPath(path, name)
+		keys[keyPath] = true
+		prop, ok := propSchema.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if enum, ok := prop["enum"].([]interface{}); ok {
+			for _, val := range enum {
+				values[keyPath] = append(values[keyPath], fmt.Sprint(val))
+			}
+		} else if prop["type"] == "boolean" {
+			values[keyPath] = []string{"true", "false"}
+		}
+		collectSchemaKeys(prop, keyPath, keys, values)
+	}
+}
+
+// parentKeys returns a key and all its parents, e.g. a:b:c returns a, a:b
+// and a:b:c
+func parentKeys(key string) []string {
+	nodes := strings.Split(key, ":")
+	var keys []string
+	for i := range nodes {
+		keys = append(keys, strings.Join(nodes[:i+1], ":"))
+	}
+	return keys
+}
+
+var nonIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// completionFunc names the shell function completing prog
+func completionFunc(prog string) string {
+	return "_" + nonIdentifier.ReplaceAllString(prog, "_") + "_config"
+}
+
+// shellQuote quotes a word for bash, zsh and fish
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func flagWords(keys []string) string {
+	words := make([]string, len(keys))
+	for i, key := range keys {
+		words[i] = "--" + key
+	}
+	return strings.Join(words, " ")
+}
+
+func valueKeys(values map[string][]string) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func bashCompletion(prog string, keys []string, values map[string][]string) string {
+	var buf bytes.Buffer
+	fn := completionFunc(prog)
+
+	fmt.Fprintf(&buf, "# bash completion for %s\n", prog)
+	fmt.Fprintf(&buf, "%s() {\n", fn)
+	// bash splits words on ":" and "=", so complete the whole flag and trim
+	// what bash considers already typed
+	buf.WriteString("    local cur=\"${COMP_LINE:0:$COMP_POINT}\"\n")
+	buf.WriteString("    cur=\"${cur##* }\"\n")
+	buf.WriteString("    local prefix=\"${cur%\"${cur##*[:=]}\"}\"\n")
+	buf.WriteString("    case \"$cur\" in\n")
+	for _, key := range valueKeys(values) {
+		fmt.Fprintf(&buf, "        --%s=*)\n", key)
+		fmt.Fprintf(&buf, "            COMPREPLY=($(compgen -P %s -W %s -- \"${cur#*=}\"))\n",
+			shellQuote("--"+key+"="), shellQuote(strings.Join(values[key], " ")))
+		buf.WriteString("            ;;\n")
+	}
+	buf.WriteString("        *)\n")
+	fmt.Fprintf(&buf, "            COMPREPLY=($(compgen -W %s -- \"$cur\"))\n", shellQuote(flagWords(keys)))
+	buf.WriteString("            ;;\n")
+	buf.WriteString("    esac\n")
+	buf.WriteString("    COMPREPLY=(\"${COMPREPLY[@]#\"$prefix\"}\")\n")
+	buf.WriteString("}\n")
+	fmt.Fprintf(&buf, "complete -o nospace -F %s %s\n", fn, shellQuote(prog))
+
+	return buf.String()
+}
+
+func zshCompletion(prog string, keys []string, values map[string][]string) string {
+	var buf bytes.Buffer
+	fn := completionFunc(prog)
+
+	fmt.Fprintf(&buf, "#compdef %s\n\n", prog)
+	fmt.Fprintf(&buf, "%s() {\n", fn)
+	buf.WriteString("    case $PREFIX in\n")
+	for _, key := range valueKeys(values) {
+		fmt.Fprintf(&buf, "        %s*)\n", shellQuote("--"+key+"="))
+		buf.WriteString("            compset -P '*='\n")
+		words := make([]string, len(values[key]))
+		for i, val := range values[key] {
+			words[i] = shellQuote(val)
+		}
+		fmt.Fprintf(&buf, "            compadd -- %s\n", strings.Join(words, " "))
+		buf.WriteString("            ;;\n")
+	}
+	buf.WriteString("        *)\n")
+	words := make([]string, len(keys))
+	for i, key := range keys {
+		words[i] = shellQuote("--" + key)
+	}
+	fmt.Fprintf(&buf, "            compadd -S '' -- %s\n", strings.Join(words, " "))
+	buf.WriteString("            ;;\n")
+	buf.WriteString("    esac\n")
+	buf.WriteString("}\n\n")
+	fmt.Fprintf(&buf, "compdef %s %s\n", fn, shellQuote(prog))
+
+	return buf.String()
+}
+
+func fishCompletion(prog string, keys []string, values map[string][]string) string {
+	var buf bytes.Buffer
+
+	descriptions := make(map[string]string)
+	for _, option := range Options() {
+		descriptions[option.Key] = option.Description
+	}
+
+	fmt.Fprintf(&buf, "# fish completion for %s\n", prog)
+	for _, key := range keys {
+		line := fmt.Sprintf("complete -c %s -l %s", shellQuote(prog), shellQuote(key))
+		if vals, ok := values[key]; ok {
+			line += fmt.Sprintf(" -x -a %s", shellQuote(strings.Join(vals, " ")))
+		}
+		if desc := descriptions[key]; desc != "" {
+			line += fmt.Sprintf(" -d %s", shellQuote(desc))
+		}
+		buf.WriteString(line + "\n")
+	}
+
+	return buf.String()
+}
@@ -3,17 +3,21 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-yaml/yaml"
 )
 
 var (
+	// ConfigPrefix is the prefix of env variables, unless EnvPrefixes is set
 	ConfigPrefix = "CONFIG"
 	config       = make(map[interface{}]interface{})
 	configMutex  = &sync.Mutex{}
@@ -28,14 +32,36 @@ type Template struct {
 
 var Templates []Template
 
-// loadYAML converts the provided data to YAML and loads it into our
-// global config. This can be called multiple times, each time will
-// merge over previous values
-func loadYAML(data []byte) error {
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return err
-	}
-	return nil
+// reservedKeys are top level keys used by config itself: the environment
+// and component selection and overrides, and the locations of config
+// sources. They are not part of the resolved config tree
+var reservedKeys = map[string]bool{
+	"env":           true,
+	"comp":          true,
+	"environment":   true,
+	"component":     true,
+	"config":        true,
+	"c":             true,
+	"uri":           true,
+	"schema":        true,
+	"cache_dir":     true,
+	"command":       true,
+	"completion":    true,
+	"age_key":       true,
+	"age_key_file":  true,
+	"data_key":      true,
+	"data_key_file": true,
+	"trusted_keys":  true,
+}
+
+// reservedEnvVars configure config itself, e.g. hold decryption keys.
+// They are not loaded into the config tree
+var reservedEnvVars = map[string]bool{
+	"CONFIG_AGE_KEY":       true,
+	"CONFIG_AGE_KEY_FILE":  true,
+	"CONFIG_DATA_KEY":      true,
+	"CONFIG_DATA_KEY_FILE": true,
+	"CONFIG_TRUSTED_KEYS":  true,
 }
 
 // getConfigURI pulls the config URI from the environment or from
@@ -64,7 +90,25 @@ func getConfigURI() string {
 // 1. Use the configuration data specified via --config or CONFIG_URI
 // 2. Environment variables (":" or "__" as separator)
 // 3. Command line args
+// 4. Defaults of options declared with Define
+// The result is then validated against the JSON Schema at CONFIG_SCHEMA,
+// if set
 func Load() error {
+	return LoadContext(context.Background())
+}
+
+// LoadContext loads configuration like Load, but gives up fetching config
+// sources once the context is cancelled or its deadline passes. Individual
+// sources may set their own deadline with a `timeout` parameter, e.g.
+// CONFIG_URI=s3://us-west-2/bucket/app.yaml?timeout=5s
+func LoadContext(ctx context.Context) error {
+
+	clearWarnings()
+
+	if helpRequested() {
+		fmt.Fprint(HelpOutput, Usage())
+		return ErrHelp
+	}
 
 	if configURIS := getConfigURI(); configURIS != "" {
 
@@ -73,51 +117,74 @@ func Load() error {
 
 		for _, configURI := range configs {
 
-			var (
-				loader Loader
-				err    error
-			)
-
-			if LoaderType(configURI) == "file" {
-				loader, err = NewFileLoader(FileConfig{Path: configURI})
-				if err != nil {
-					return err
-				}
+			loader, err := loaderForURI(configURI)
+			if err != nil {
+				return err
 			}
 
-			if LoaderType(configURI) == "s3" {
-				s3Config, err := S3ConfigFromURI(configURI)
-				if err != nil {
-					return err
-				}
-				loader, err = NewS3Loader(s3Config)
-				if err != nil {
-					return err
-				}
+			data, err := fetch(ctx, configURI, loader)
+			if err != nil {
+				return err
 			}
 
-			if loader != nil {
-				data, err := loader.Load()
-				if err != nil {
-					return err
-				}
+			// decrypt encrypted documents, e.g. app.yaml.age
+			source, _, _ := splitURIParams(configURI)
+			if data, err = decryptDocument(source, data); err != nil {
+				return err
+			}
 
-				if err := loadYAML(data); err != nil {
-					return err
-				}
+			if err := loadYAMLContext(ctx, source, data); err != nil {
+				return err
 			}
 		}
 	}
 
+	// print a completion script for the keys of the config sources if
+	// asked to
+	if shell := completionRequested(); shell != "" {
+		return printCompletion(ctx, shell)
+	}
+
+	// catch typos in flags and env variables, now that the keys defined by
+	// config files are known
+	if err := checkUnknownKeys(knownKeys()); err != nil {
+		return err
+	}
+
 	// overwrite w/ env variables (starting with CONFIG_)
 	loadEnvironmentVariables()
 
 	// overwrite w/ command flags
 	loadCommandLineArgs()
 
+	// overwrite w/ flags set in bound flag sets, and fill in their defaults
+	loadFlagSets()
+
+	// replace secret references with their secrets
+	if err := resolveSecrets(ctx); err != nil {
+		return err
+	}
+
+	// fill in defaults and check the types of declared options
+	if err := applyOptions(); err != nil {
+		return err
+	}
+
 	// Set reserved config variables
 	setEnvironment()
 
+	// catch ${...} expressions that can't be expanded, e.g. reference cycles
+	if err := checkTemplates(); err != nil {
+		return err
+	}
+
+	// check the merged config against its schema
+	if schemaURI := os.Getenv("CONFIG_SCHEMA"); schemaURI != "" {
+		if err := validateSchemaURI(ctx, schemaURI); err != nil {
+			return err
+		}
+	}
+
 	return nil
 
 }
@@ -165,6 +232,8 @@ func setEnvironment() {
 
 func Reset() {
 	config = make(map[interface{}]interface{})
+	resetPositions()
+	clearWarnings()
 }
 
 func nodes(key string) []string {
@@ -182,18 +251,25 @@ func normalizeKey(key string) string {
 }
 
 // stripConfigPrefix returns a string stripped of any of the different
-// acceptable config prefixes. The second return value indicates whether
-// or not the string has a config prefix
+// acceptable config prefixes, lower-cased. The second return value
+// indicates whether or not the string has a config prefix
 func stripConfigPrefix(s string) (string, bool) {
-	configPrefixes := []string{
-		fmt.Sprintf("%s__", ConfigPrefix),
-		fmt.Sprintf("%s_", ConfigPrefix),
-		fmt.Sprintf("%s:", ConfigPrefix),
-	}
-	compareString := strings.ToUpper(s)
-	for _, prefix := range configPrefixes {
-		if strings.HasPrefix(compareString, prefix) {
-			return strings.TrimPrefix(compareString, prefix), true
+	for _, prefix := range envPrefixes() {
+		if stripped, ok := stripPrefix(s, prefix); ok {
+			return stripped, true
+		}
+	}
+	return s, false
+}
+
+// stripPrefix strips a prefix followed by EnvSeparator, "_" or ":" from a
+// string, ignoring case
+func stripPrefix(s, prefix string) (string, bool) {
+	prefix = strings.ToLower(strings.TrimRight(prefix, "_:"))
+	compareString := strings.ToLower(s)
+	for _, sep := range []string{strings.ToLower(EnvSeparator), "_", ":"} {
+		if sep != "" && strings.HasPrefix(compareString, prefix+sep) {
+			return strings.TrimPrefix(compareString, prefix+sep), true
 		}
 	}
 	return s, false
@@ -240,6 +316,7 @@ func mkPath(fullKey string) (map[interface{}]interface{}, interface{}) {
 
 // Set lets you set/override specific leaves of the config tree
 func Set(keyPath string, value interface{}) {
+	clearPositions(normalizeKey(keyPath))
 	node, key := mkPath(keyPath)
 	configMutex.Lock()
 	node[key] = value
@@ -249,6 +326,7 @@ func Set(keyPath string, value interface{}) {
 // SetJSON allows you to set an entire JSON string into the config
 // If the provided json string is invalid, you will receive an error
 func SetJSON(keyPath string, jsonString string) error {
+	clearPositions(normalizeKey(keyPath))
 	node, key := mkPath(keyPath)
 
 	// Get the JSON
@@ -277,6 +355,20 @@ func SetJSON(keyPath string, jsonString string) error {
 	return nil
 }
 
+// SetYAML sets a key to the value of a YAML document
+func SetYAML(keyPath string, yamlString string) error {
+	var values interface{}
+	if err := yaml.Unmarshal([]byte(yamlString), &values); err != nil {
+		return err
+	}
+	clearPositions(normalizeKey(keyPath))
+	node, key := mkPath(keyPath)
+	configMutex.Lock()
+	node[key] = values
+	configMutex.Unlock()
+	return nil
+}
+
 func SetList(key string, list string) {
 	// TODO: parse list into a string array and set it
 }
@@ -284,7 +376,7 @@ func SetList(key string, list string) {
 // GetAny returns whatever it finds at a specific config node
 func GetAny(key string) interface{} {
 	cfg := getEnvironmentedT(key)
-	cfg = evalTemplatesAll(cfg)
+	cfg = evalTemplatesAll(key, cfg)
 	return cfg
 }
 
@@ -299,11 +391,13 @@ func Get(key string) string {
 // If the specified key does not exist, an empty
 // string is returned.
 func GetString(key string) string {
-	switch v := getEnvironmentedT(key).(type) {
+	switch v := GetAny(key).(type) {
 	case string:
-		return evalTemplate(v)
+		return v
 	case int:
 		return strconv.Itoa(v)
+	case int64, uint64, float64, bool:
+		return fmt.Sprint(v)
 	}
 	return ""
 }
@@ -312,9 +406,14 @@ func GetString(key string) string {
 // specified key exists, 0 if the key does
 // not exist
 func GetInt(key string) int {
-	switch v := getEnvironmentedT(key).(type) {
+	switch v := GetAny(key).(type) {
 	case int:
 		return v
+	case bool:
+		// bare flags used to be "1"
+		if v {
+			return 1
+		}
 	case string:
 		if n, err := strconv.Atoi(v); err == nil {
 			return n
@@ -327,7 +426,7 @@ func GetInt(key string) int {
 // specified key exists, false if the key does
 // not exist
 func GetBool(key string) bool {
-	switch v := getEnvironmentedT(key).(type) {
+	switch v := GetAny(key).(type) {
 	case bool:
 		return v
 	case string:
@@ -338,6 +437,38 @@ func GetBool(key string) bool {
 	return false
 }
 
+// GetFloat returns a value as a float64 if the
+// specified key exists, 0 if the key does
+// not exist
+func GetFloat(key string) float64 {
+	switch v := GetAny(key).(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return 0
+}
+
+// GetDuration returns a value such as "1m30s"
+// as a time.Duration if the specified key
+// exists, 0 if the key does not exist
+func GetDuration(key string) time.Duration {
+	switch v := GetAny(key).(type) {
+	case string:
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	case int:
+		return time.Duration(v)
+	}
+	return 0
+}
+
 // getEnvironmentedT will return the component and non-component
 // environment-overridden configuration value if it exists. Resolves more
 // specific definitions first. The specific order is:
@@ -347,36 +478,51 @@ func getEnvironmentedT(key string) interface{} {
 	// Order is important here.
 	// We start at the top of the config
 	// and walk our way down by overwriting the config values as we find them.
+	layers := overlayKeys(key)
 
 	// first get the default value (the top level value)
-	val := getT(key)
+	val := getT(layers[0])
 
-	// now look for the  key in the environment
-	envValue := getT(fmt.Sprintf("environment:%s:%s", environment, key))
+	// If we found a value in one of the overrides overwrite its fields with
+	// the less specific one.
+	for _, layer := range layers[1:] {
+		if layerVal := getT(layer); layerVal != nil {
+			val = merge(layerVal, val)
+		}
+	}
 
-	// If we found a value in the environemnt overwrite its fields with
-	// the default one.
-	if envValue != nil {
-		val = merge(envValue, val)
+	return val
+}
+
+// overlayKeys returns the keys that may define key, from the least
+// specific (the top level key) to the most specific (the component's
+// environment)
+func overlayKeys(key string) []string {
+	layers := []string{
+		key,
+		joinKeys("environment", environment, key),
 	}
 
-	// If we have a component lets write those values.
+	// If we have a component, it gets its own top level and env
 	if component != "" {
+		layers = append(layers,
+			joinKeys("component", component, key),
+			joinKeys("component", component, "environment", environment, key),
+		)
+	}
 
-		// Look for key in top level of the component
-		componentVal := getT(fmt.Sprintf("component:%s:%s", component, key))
-		if componentVal != nil {
-			val = merge(componentVal, val)
-		}
+	return layers
+}
 
-		// Look for key in component's env
-		componentEnvValue := getT(fmt.Sprintf("component:%s:environment:%s:%s", component, environment, key))
-		if componentEnvValue != nil {
-			val = merge(componentEnvValue, val)
+// joinKeys joins the non-empty parts of a key path with ":"
+func joinKeys(parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
 		}
 	}
-
-	return val
+	return strings.Join(nonEmpty, ":")
 }
 
 // getT walks the node-tree rooted at the node stored in config.
@@ -414,65 +560,75 @@ func getT(key string) interface{} {
 	return val
 }
 
-// GetAll gives you access to the raw config var
-// Useful for debugging
+// resolved returns the config tree as seen through the current environment
+// and component, without reserved keys. Keys that only exist in an override
+// are included
+func resolved() map[interface{}]interface{} {
+	view := make(map[interface{}]interface{})
+	for _, name := range resolvedKeys() {
+		val := GetAny(name)
+		if val == nil {
+			// keys that can't be read back, e.g. mixed case ones
+			val = config[name]
+		}
+		view[name] = val
+	}
+	return view
+}
+
+// resolvedKeys returns the top level keys of the resolved config tree
+func resolvedKeys() []string {
+	keys := make(map[string]bool)
+	for k := range config {
+		keys[fmt.Sprint(k)] = true
+	}
+	for _, layer := range overlayKeys("")[1:] {
+		layerMap, _ := getT(layer).(map[interface{}]interface{})
+		for k := range layerMap {
+			keys[fmt.Sprint(k)] = true
+		}
+	}
+
+	var names []string
+	for name := range keys {
+		if !reservedKeys[strings.ToLower(name)] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetAll gives you a copy of the raw config var, with the values of
+// sensitive keys masked. Useful for debugging
 func GetAll() map[interface{}]interface{} {
-	return config
+	return redact(config, "").(map[interface{}]interface{})
 }
 
-// ToYAML returns the current config as a YAML doc
-// Useful for debugging
+// ToYAML returns the current config as a YAML doc, with the values of
+// sensitive keys masked. Useful for debugging
 func ToYAML() string {
-	out, _ := yaml.Marshal(config)
+	out, _ := yaml.Marshal(redact(config, ""))
 	return string(out)
 }
 
-// ToGo returns a Go-syntax representation of the config
-func ToGo() string {
-	return fmt.Sprintf("%#v", config)
-}
-
-// evalTemplate replaces all templatized variables in the given string
-// with their evaluated values
-func evalTemplate(s string) string {
-	for _, template := range Templates {
-		s = strings.Replace(
-			s,
-			fmt.Sprintf("{%s}", template.Search),
-			template.Replace,
-			-1,
-		)
-	}
-	return s
+// ToYAMLUnredacted returns the current config as a YAML doc, secrets
+// included. Only use it for local debugging
+func ToYAMLUnredacted() string {
+	out, _ := yaml.Marshal(config)
+	return string(out)
 }
 
-// evalTemplatesAll replaces all templatized variables in the given
-// nested config
-func evalTemplatesAll(cfg interface{}) interface{} {
-	switch cfg := cfg.(type) {
-	case bool, int:
-		return cfg
-	case string:
-		return evalTemplate(cfg)
-	case []interface{}:
-		var _cfg []interface{}
-		for _, item := range cfg {
-			_cfg = append(_cfg, evalTemplatesAll(item))
-		}
-		return _cfg
-	case map[interface{}]interface{}:
-		_cfg := make(map[interface{}]interface{})
-		for k, v := range cfg {
-			_cfg[k] = evalTemplatesAll(v)
-		}
-		return _cfg
-	}
-	return cfg
+// ToGo returns a Go-syntax representation of the config, with the values
+// of sensitive keys masked
+func ToGo() string {
+	return fmt.Sprintf("%#v", redact(config, ""))
 }
 
 // merge two maps.
 // src values are used on both src and dst.
 // if the values are not maps, src is returned.
+// Neither map is modified; a merged copy is returned
 func merge(srcAInterface, dstAsInterface interface{}) interface{} {
 	src, ok := srcAInterface.(map[interface{}]interface{})
 	if !ok {
@@ -484,15 +640,15 @@ func merge(srcAInterface, dstAsInterface interface{}) interface{} {
 		return srcAInterface
 	}
 
+	merged := make(map[interface{}]interface{}, len(dst)+len(src))
+	for key, dstVal := range dst {
+		merged[key] = dstVal
+	}
 	for key, srcVal := range src {
-		if dstVal, ok := dst[key]; ok {
-			srcMap, srcMapOk := srcVal.(map[interface{}]interface{})
-			dstMap, dstMapOk := dstVal.(map[interface{}]interface{})
-			if srcMapOk && dstMapOk {
-				srcVal = merge(dstMap, srcMap)
-			}
+		if dstVal, ok := merged[key]; ok {
+			srcVal = merge(srcVal, dstVal)
 		}
-		dst[key] = srcVal
+		merged[key] = srcVal
 	}
-	return dst
+	return merged
 }
@@ -1,13 +1,30 @@
 package config
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"filippo.io/age"
+	"filippo.io/age/armor"
 	"github.com/mitchellh/mapstructure"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/spf13/pflag"
 )
 
 func TestUnitConfig(t *testing.T) {
@@ -15,6 +32,29 @@ func TestUnitConfig(t *testing.T) {
 	RunSpecs(t, "Config Suite")
 }
 
+// slowLoader is a plain Loader that takes a while to return
+type slowLoader struct {
+	delay time.Duration
+}
+
+func (l slowLoader) Load() ([]byte, error) {
+	time.Sleep(l.delay)
+	return []byte("slow: true"), nil
+}
+
+// flakyLoader returns its data until it is told to fail
+type flakyLoader struct {
+	data []byte
+	fail bool
+}
+
+func (l *flakyLoader) Load() ([]byte, error) {
+	if l.fail {
+		return nil, errors.New("unreachable")
+	}
+	return l.data, nil
+}
+
 var _ = Describe("config", func() {
 
 	Describe("basic string set", func() {
@@ -241,8 +281,9 @@ var _ = Describe("config", func() {
 
 		Context("received a template variable in config", func() {
 			os.Setenv("CONFIG_ROOT", "..")
-			Set("key", "{ConfigRoot}/file.ext")
+			Set("key", "${env:CONFIG_ROOT}/file.ext")
 			actual := Get("key")
+			os.Unsetenv("CONFIG_ROOT")
 			It("should have template applied", func() {
 				expected := filepath.Join("../file.ext")
 				Expect(actual).Should(Equal(expected))
@@ -252,11 +293,12 @@ var _ = Describe("config", func() {
 		Context("received template variables in nested config", func() {
 			os.Setenv("CONFIGROOT", "..")
 			SetJSON("people", `[
-                {"id":"a", "hair":"black", "file":"{ConfigRoot}/file.ext"},
-                {"id":"b", "hair":"red", "file":"{ConfigRoot}/file2.ext"}
+                {"id":"a", "hair":"black", "file":"${CONFIGROOT}/file.ext"},
+                {"id":"b", "hair":"red", "file":"${env:CONFIGROOT}/file2.ext"}
             ]`)
 
 			peopleGoo := GetAny("people")
+			os.Unsetenv("CONFIGROOT")
 			type person struct {
 				ID   string
 				Hair string
@@ -277,6 +319,1974 @@ var _ = Describe("config", func() {
 
 		})
 
+		Context("received key references and defaults", func() {
+			Reset()
+			Set("server:host", "localhost")
+			Set("server:port", 8080)
+			Set("url", "http://${key:server:host}:${key:server:port}/api")
+			Set("fallback", "${key:server:scheme:-http}://${CONFIG_MISSING_HOST:-${key:server:host}}")
+			Set("escaped", "$${HOME} costs $5")
+			Set("legacy", "{Dir}/file.ext")
+			Templates = []Template{{Search: "Dir", Replace: "/etc"}}
+			url := Get("url")
+			fallback := Get("fallback")
+			escaped := GetAny("escaped")
+			legacy := Get("legacy")
+			Templates = nil
+			expanded, expandErr := Expand("${key:url}")
+
+			It("should expand references", func() {
+				Expect(url).Should(Equal("http://localhost:8080/api"))
+				Expect(expandErr).Should(BeNil())
+				Expect(expanded).Should(Equal(url))
+			})
+
+			It("should use defaults", func() {
+				Expect(fallback).Should(Equal("http://localhost"))
+			})
+
+			It("should keep escaped expressions", func() {
+				Expect(escaped).Should(Equal("${HOME} costs $5"))
+			})
+
+			It("should still apply Templates", func() {
+				Expect(legacy).Should(Equal("/etc/file.ext"))
+			})
+		})
+
+		Context("received bare key references", func() {
+			Reset()
+			Set("server:host", "localhost")
+			Set("server:port", 8080)
+			Set("environment:prod:server:host", "prod.example.com")
+			Set("url", "http://${server:host}:${server:port}/api")
+			Set("flags:debug", true)
+			Set("defaults:timeout", "1m")
+			Set("defaults:db:host", "db.local")
+			Set("app:port", "${server:port}")
+			Set("app:debug", "${flags:debug}")
+			Set("app:timeout", "${defaults:timeout}")
+			Set("app:ratio", "${defaults:ratio:-0.5}")
+			Set("app:db", "${defaults:db}")
+			previous := environment
+			environment = "dev"
+			devURL := Get("url")
+			environment = "prod"
+			prodURL := Get("url")
+			environment = previous
+			port := GetAny("app:port")
+			portInt := GetInt("app:port")
+			debug := GetBool("app:debug")
+			timeout := GetDuration("app:timeout")
+			ratio := GetFloat("app:ratio")
+			db := GetAny("app:db")
+			Reset()
+
+			It("should resolve through the current environment", func() {
+				Expect(devURL).Should(Equal("http://localhost:8080/api"))
+				Expect(prodURL).Should(Equal("http://prod.example.com:8080/api"))
+			})
+
+			It("should keep the type of sole references", func() {
+				Expect(port).Should(Equal(8080))
+				Expect(db).Should(Equal(map[interface{}]interface{}{"host": "db.local"}))
+			})
+
+			It("should apply to typed getters", func() {
+				Expect(portInt).Should(Equal(8080))
+				Expect(debug).Should(BeTrue())
+				Expect(timeout).Should(Equal(time.Minute))
+				Expect(ratio).Should(Equal(0.5))
+			})
+		})
+
+		Context("received a reference cycle", func() {
+			Reset()
+			Set("a", "${key:b}")
+			Set("b", "x${key:c}")
+			Set("c", "${key:a}")
+			Set("missing", "${key:nope}")
+			raw := Get("a")
+			err := checkTemplates()
+			_, expandErr := Expand("${key:a}")
+			Reset()
+
+			It("should leave the value as it is", func() {
+				Expect(raw).Should(Equal("${key:b}"))
+			})
+
+			It("should report the cycle", func() {
+				Expect(err).ShouldNot(BeNil())
+				Expect(err.Error()).Should(ContainSubstring("a: reference cycle a -> b -> c -> a"))
+				Expect(err.Error()).Should(ContainSubstring("missing: ${key:nope} references nope, which is not set"))
+				Expect(err.(Errors)).Should(HaveLen(2))
+				Expect(expandErr.Error()).Should(Equal("a: reference cycle a -> b -> c -> a"))
+			})
+		})
+
+		Context("unmarshalled into a struct", func() {
+			type server struct {
+				Host string   `yaml:"host"`
+				Port int      `yaml:"port"`
+				URL  string   `yaml:"url"`
+				Tags []string `yaml:"tags"`
+			}
+			Reset()
+			loadYAML("base.yaml", []byte("server:\n  host: localhost\n  port: 8080\n  url: http://${key:server:host}:${key:server:port}\n  tags: [\"${key:server:host}\"]\n"))
+			var one server
+			oneErr := Unmarshal("server", &one)
+			var all struct {
+				Server server `yaml:"server"`
+			}
+			allErr := Unmarshal("", &all)
+			Reset()
+
+			It("should decode expanded values", func() {
+				Expect(oneErr).Should(BeNil())
+				Expect(one).Should(Equal(server{Host: "localhost", Port: 8080, URL: "http://localhost:8080", Tags: []string{"localhost"}}))
+				Expect(allErr).Should(BeNil())
+				Expect(all.Server).Should(Equal(one))
+			})
+		})
+
+		Context("received text that is not an expression", func() {
+			Reset()
+			Set("greeting", "Hello {{name}}")
+			Set("script", "echo ${#hosts[@]} ${1} $${HOME} ${unterminated")
+			Set("awk", "${NF}")
+			greeting := Get("greeting")
+			script := Get("script")
+			awk := Get("awk")
+			err := checkTemplates()
+			Reset()
+
+			It("should keep it as it is", func() {
+				Expect(greeting).Should(Equal("Hello {{name}}"))
+				Expect(script).Should(Equal("echo ${#hosts[@]} ${1} ${HOME} ${unterminated"))
+				Expect(err).Should(BeNil())
+			})
+
+			It("should still expand valid expressions", func() {
+				Expect(awk).Should(Equal(os.Getenv("NF")))
+			})
+		})
+
+		Context("received from a remote source", func() {
+			Reset()
+			TemplateActions = true
+			os.Setenv("CONFIG_REMOTE_SECRET", "hunter2")
+			loadYAML("https://example.com/app.yaml", []byte(
+				"url: http://x/?k=${env:CONFIG_REMOTE_SECRET}\n"+
+					"bare: ${CONFIG_REMOTE_SECRET}\n"+
+					"hosts:\n  - '{{ env \"CONFIG_REMOTE_SECRET\" }}'\n"+
+					"cert: '{{ file \"/etc/hostname\" }}'\n"+
+					"name: ${key:app:name}\n"))
+			loadYAML("base.yaml", []byte("app:\n  name: ${CONFIG_REMOTE_SECRET}\n"))
+			url := Get("url")
+			bare := Get("bare")
+			name := Get("name")
+			err := checkTemplates()
+			os.Unsetenv("CONFIG_REMOTE_SECRET")
+			TemplateActions = false
+			Reset()
+
+			It("should not read env variables or files", func() {
+				Expect(url).Should(Equal("http://x/?k=${env:CONFIG_REMOTE_SECRET}"))
+				Expect(bare).Should(Equal("${CONFIG_REMOTE_SECRET}"))
+				Expect(err).ShouldNot(BeNil())
+				Expect(err.Error()).Should(ContainSubstring("url: values from https://example.com/app.yaml cannot read env variables"))
+				Expect(err.Error()).Should(ContainSubstring("hosts: values from https://example.com/app.yaml cannot read env variables"))
+				Expect(err.Error()).Should(ContainSubstring("cert: values from https://example.com/app.yaml cannot read files"))
+				Expect(err.(Errors)).Should(HaveLen(4))
+			})
+
+			It("should still reference keys of local sources", func() {
+				Expect(name).Should(Equal("hunter2"))
+			})
+		})
+
+		Context("received template functions", func() {
+			Reset()
+			TemplateActions = true
+			dir, _ := ioutil.TempDir("", "funcs")
+			ioutil.WriteFile(filepath.Join(dir, "token"), []byte("s3cr3t\n"), 0600)
+			os.Setenv("CONFIG_FUNCS_USER", "alice")
+			os.Setenv("CONFIG_FUNCS_INJECT", `{{ env "CONFIG_FUNCS_USER" }}`)
+			Set("name", `{{ env "CONFIG_FUNCS_USER" | upper }}`)
+			Set("fallback", `{{ env "CONFIG_FUNCS_NOPE" | default "nobody" }}`)
+			Set("hosts", []interface{}{"a", "b", "c"})
+			Set("joined", `{{ key "hosts" | join "," }}`)
+			Set("encoded", `{{ base64 "abc" }} {{ sha256 "abc" }}`)
+			Set("token", fmt.Sprintf(`{{ file %q }}`, filepath.Join(dir, "token")))
+			Set("timeout", "1m")
+			Set("deadline", `{{ add (key "timeout") "30s" }}`)
+			Set("doubled", `{{ mul (duration "45s") 2 }}`)
+			Set("ratio", `{{ div (key "timeout") (duration "30s") }}`)
+			Set("sum", `{{ add 2 3 }}`)
+			Set("mixed", `${CONFIG_FUNCS_USER}-{{ lower "ID" }}`)
+			Set("injected", `${CONFIG_FUNCS_INJECT}{{ "" }}`)
+			Set("host", `{{ hostname }}`)
+			Set("year", `{{ now.Year }}`)
+			Set("broken", `{{ nope }}`)
+			Set("loop", `{{ key "loop" }}`)
+			name := Get("name")
+			fallback := Get("fallback")
+			joined := Get("joined")
+			encoded := Get("encoded")
+			token := Get("token")
+			deadline := GetDuration("deadline")
+			doubled := Get("doubled")
+			ratio := GetFloat("ratio")
+			sum := GetInt("sum")
+			mixed := Get("mixed")
+			injected := Get("injected")
+			host := Get("host")
+			hostname, _ := os.Hostname()
+			year := GetInt("year")
+			err := checkTemplates()
+			os.Unsetenv("CONFIG_FUNCS_USER")
+			os.Unsetenv("CONFIG_FUNCS_INJECT")
+			os.RemoveAll(dir)
+			TemplateActions = false
+			Reset()
+
+			It("should apply string functions", func() {
+				Expect(name).Should(Equal("ALICE"))
+				Expect(fallback).Should(Equal("nobody"))
+				Expect(joined).Should(Equal("a,b,c"))
+				Expect(encoded).Should(Equal("YWJj ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"))
+				Expect(token).Should(Equal("s3cr3t"))
+				Expect(host).Should(Equal(hostname))
+				Expect(year).Should(Equal(time.Now().Year()))
+			})
+
+			It("should do duration math", func() {
+				Expect(deadline).Should(Equal(90 * time.Second))
+				Expect(doubled).Should(Equal("1m30s"))
+				Expect(ratio).Should(Equal(2.0))
+				Expect(sum).Should(Equal(5))
+			})
+
+			It("should run after expressions without executing their text", func() {
+				Expect(mixed).Should(Equal("alice-id"))
+				Expect(injected).Should(Equal(`{{ env "CONFIG_FUNCS_USER" }}`))
+			})
+
+			It("should report broken actions", func() {
+				Expect(err).ShouldNot(BeNil())
+				Expect(err.Error()).Should(ContainSubstring(`function "nope" not defined`))
+				Expect(err.Error()).Should(ContainSubstring("reference cycle loop -> loop"))
+			})
+		})
+	})
+
+	Describe("context loaders", func() {
+
+		Context("plain loader within deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			data, err := AsContextLoader(slowLoader{time.Millisecond}).LoadContext(ctx)
+			cancel()
+			It("should return the loaded data", func() {
+				Expect(err).Should(BeNil())
+				Expect(string(data)).Should(Equal("slow: true"))
+			})
+		})
+
+		Context("plain loader past deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			_, err := AsContextLoader(slowLoader{time.Second}).LoadContext(ctx)
+			cancel()
+			It("should return the context error", func() {
+				Expect(errors.Is(err, context.DeadlineExceeded)).Should(BeTrue())
+			})
+		})
+
+		Context("cancelled file loader", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			loader, _ := NewFileLoader(FileConfig{Path: "test/config/config.yaml"})
+			_, err := loader.LoadContext(ctx)
+			It("should return the context error", func() {
+				Expect(err).Should(Equal(context.Canceled))
+			})
+		})
+
+		Context("s3 uri with timeout", func() {
+			s3Config, err := S3ConfigFromURI("s3://us-west-2/bucket/path/app.yaml?timeout=5s")
+			It("should parse all parts", func() {
+				Expect(err).Should(BeNil())
+				Expect(s3Config.Region).Should(Equal("us-west-2"))
+				Expect(s3Config.Bucket).Should(Equal("bucket"))
+				Expect(s3Config.Key).Should(Equal("path/app.yaml"))
+				Expect(s3Config.Timeout).Should(Equal(5 * time.Second))
+			})
+		})
+
+		Context("file uri with invalid timeout", func() {
+			_, err := FileConfigFromURI("config.yaml?timeout=soon")
+			It("should return an error", func() {
+				Expect(err).ShouldNot(BeNil())
+			})
+		})
+
+	})
+
+	Describe("remote source cache", func() {
+
+		dir, _ := ioutil.TempDir("", "config-cache")
+		CacheDir = dir
+		uri := "s3://us-west-2/bucket/app.yaml"
+		loader := &flakyLoader{data: []byte("cached: yes")}
+
+		Context("successful fetch", func() {
+			Reset()
+			data, err := fetch(context.Background(), uri, AsContextLoader(loader))
+			It("should return the fetched data without warnings", func() {
+				Expect(err).Should(BeNil())
+				Expect(string(data)).Should(Equal("cached: yes"))
+			})
+		})
+
+		Context("failed fetch", func() {
+			Reset()
+			loader.fail = true
+			data, err := fetch(context.Background(), uri+"?timeout=1s", AsContextLoader(loader))
+			warnings := Warnings()
+			It("should fall back to the cached copy", func() {
+				Expect(err).Should(BeNil())
+				Expect(string(data)).Should(Equal("cached: yes"))
+			})
+			It("should report a stale source", func() {
+				Expect(warnings).Should(HaveLen(1))
+				_, ok := warnings[0].(*StaleSourceError)
+				Expect(ok).Should(BeTrue())
+			})
+		})
+
+		Context("failed fetch without cached copy", func() {
+			_, err := fetch(context.Background(), "s3://us-west-2/bucket/other.yaml", AsContextLoader(loader))
+			It("should return the fetch error", func() {
+				Expect(err).ShouldNot(BeNil())
+			})
+		})
+
+		Context("file sources", func() {
+			loader.fail = false
+			fetch(context.Background(), "local.yaml", AsContextLoader(loader))
+			docPath, _ := cachePaths(dir, "local.yaml")
+			It("should not be cached", func() {
+				Expect(pathExists(docPath)).Should(BeFalse())
+			})
+		})
+
+		Context("uri parameters", func() {
+			first, _ := cachePaths(dir, "https://h/app.yaml?version=1")
+			second, _ := cachePaths(dir, "https://h/app.yaml?version=2")
+			timeout, _ := cachePaths(dir, "https://h/app.yaml?timeout=5s&version=1")
+			It("should only ignore the timeout", func() {
+				Expect(first).ShouldNot(Equal(second))
+				Expect(timeout).Should(Equal(first))
+			})
+		})
+
+		CacheDir = ""
+
+	})
+
+	Describe("yaml provenance", func() {
+
+		Reset()
+		err := loadYAML("base.yaml", []byte(`server:
+  host: localhost
+  port: 8080
+environment:
+  prod:
+    server:
+      port: 80
+`))
+		hostPos, hostOk := PositionOf("server:host")
+		explained := Explain("server:port")
+
+		It("should load without error", func() {
+			Expect(err).Should(BeNil())
+		})
+
+		It("should record key positions", func() {
+			Expect(hostOk).Should(BeTrue())
+			Expect(hostPos.String()).Should(Equal("base.yaml:2:3"))
+		})
+
+		It("should explain where a value was defined", func() {
+			Expect(explained).Should(Equal("server:port = 8080 (base.yaml:3:3)"))
+		})
+
+		Context("environment override", func() {
+			Set("env", "prod")
+			setEnvironment()
+			explained := Explain("server:port")
+			Set("env", "dev")
+			setEnvironment()
+			It("should cite the overriding key", func() {
+				Expect(explained).Should(Equal("server:port = 80 (base.yaml:7:7 via environment:prod:server:port)"))
+			})
+		})
+
+		Context("runtime override", func() {
+			Set("server:host", "example.com")
+			_, ok := PositionOf("server:host")
+			It("should forget the file position", func() {
+				Expect(ok).Should(BeFalse())
+			})
+		})
+
+		Context("duplicate keys", func() {
+			Reset()
+			loadYAML("dup.yaml", []byte("a: 1\nb: 2\na: 3\n"))
+			warnings := Warnings()
+			actual := GetInt("a")
+			It("should keep the last value", func() {
+				Expect(actual).Should(Equal(3))
+			})
+			It("should warn with both positions", func() {
+				Expect(warnings).Should(HaveLen(1))
+				Expect(warnings[0].Error()).Should(Equal(`dup.yaml:3:1: duplicate key "a", first defined at dup.yaml:1:1`))
+			})
+		})
+
+		Context("invalid yaml", func() {
+			err := loadYAML("bad.yaml", []byte("a: [1, 2"))
+			It("should name the source", func() {
+				Expect(err).ShouldNot(BeNil())
+				Expect(err.Error()).Should(HavePrefix("bad.yaml: "))
+			})
+		})
+
+	})
+
+	Describe("yaml values", func() {
+
+		Context("YAML 1.1 bools", func() {
+			Reset()
+			err := loadYAML("base.yaml", []byte("enabled: yes\ndebug: on\nverbose: Off\ncolor: N\nquoted: \"yes\"\ntagged: !!str on\non: trigger\n"))
+			enabled := GetBool("enabled")
+			debug := GetAny("debug")
+			verbose := GetAny("verbose")
+			color := GetAny("color")
+			quoted := GetAny("quoted")
+			tagged := GetAny("tagged")
+			key := GetAny("on")
+			Reset()
+
+			It("should read plain values as bools", func() {
+				Expect(err).Should(BeNil())
+				Expect(enabled).Should(BeTrue())
+				Expect(debug).Should(Equal(true))
+				Expect(verbose).Should(Equal(false))
+				Expect(color).Should(Equal(false))
+			})
+
+			It("should keep quoted and tagged values and keys as strings", func() {
+				Expect(quoted).Should(Equal("yes"))
+				Expect(tagged).Should(Equal("on"))
+				Expect(key).Should(Equal("trigger"))
+			})
+		})
+
+		Context("aliases", func() {
+			Reset()
+			okErr := loadYAML("base.yaml", []byte("base: &base\n  port: 80\none: *base\ntwo: *base\n"))
+			one := GetAny("one")
+			two := GetAny("two")
+			Reset()
+
+			// every level multiplies the nodes of the previous one by 10
+			doc := "a0: &a0 [x, x, x, x, x, x, x, x, x, x]\n"
+			for i := 1; i <= 8; i++ {
+				prev := fmt.Sprintf("*a%d", i-1)
+				doc += fmt.Sprintf("a%d: &a%d [%s]\n", i, i, strings.TrimSuffix(strings.Repeat(prev+", ", 10), ", "))
+			}
+			start := time.Now()
+			laughsErr := loadYAML("laughs.yaml", []byte(doc))
+			elapsed := time.Since(start)
+			laughs := GetAny("a8")
+			Reset()
+
+			It("should expand them", func() {
+				Expect(okErr).Should(BeNil())
+				Expect(one).Should(Equal(map[interface{}]interface{}{"port": 80}))
+				Expect(two).Should(Equal(one))
+			})
+
+			It("should stop expanding too many", func() {
+				Expect(laughsErr).ShouldNot(BeNil())
+				Expect(laughsErr.Error()).Should(ContainSubstring("aliases expand to more than"))
+				Expect(laughs).Should(BeNil())
+				Expect(elapsed).Should(BeNumerically("<", 5*time.Second))
+			})
+		})
+
+	})
+
+	Describe("key collisions", func() {
+
+		Context("case collision", func() {
+			Reset()
+			err := loadYAML("case.yaml", []byte("Port: 1\nport: 2\n"))
+			warnings := Warnings()
+			It("should warn with both positions", func() {
+				Expect(err).Should(BeNil())
+				Expect(warnings).Should(HaveLen(1))
+				Expect(warnings[0].Error()).Should(Equal(`case.yaml:2:1: key "port" collides with "Port" defined at case.yaml:1:1`))
+			})
+		})
+
+		Context("strict mode", func() {
+			Reset()
+			StrictKeys = true
+			err := loadYAML("strict.yaml", []byte("Server:\n  Host: a\n  Port: 1\n  port: 2\n  Port: 3\n"))
+			Reset()
+			loadYAML("strict.yaml", []byte("Server:\n  Host: a\n"))
+			actual := Get("Server:Host")
+			_, mixedCaseKept := GetAll()["Server"]
+			StrictKeys = false
+			It("should fail on every collision", func() {
+				Expect(err).ShouldNot(BeNil())
+				errs, ok := err.(Errors)
+				Expect(ok).Should(BeTrue())
+				Expect(errs).Should(HaveLen(2))
+				_, isCollision := errs[0].(*CaseCollisionError)
+				Expect(isCollision).Should(BeTrue())
+				_, isCollision = errs[1].(*CaseCollisionError)
+				Expect(isCollision).Should(BeTrue())
+			})
+			It("should normalize keys", func() {
+				Expect(actual).Should(Equal("a"))
+				Expect(mixedCaseKept).Should(BeFalse())
+			})
+		})
+
+	})
+
+	Describe("nested overrides", func() {
+		Reset()
+		Set("a:b:c", "default")
+		Set("a:b:d", "default")
+		Set("environment:test:a:b:c", "override")
+		Set("env", "test")
+		setEnvironment()
+		resolvedC := Get("a:b:c")
+		resolvedD := Get("a:b:d")
+		Set("env", "dev")
+		setEnvironment()
+		defaultC := Get("a:b:c")
+
+		It("should prefer the override at any depth", func() {
+			Expect(resolvedC).Should(Equal("override"))
+			Expect(resolvedD).Should(Equal("default"))
+		})
+
+		It("should not leak the override into the defaults", func() {
+			Expect(defaultC).Should(Equal("default"))
+		})
+	})
+
+	Describe("schema validation", func() {
+
+		Context("valid config", func() {
+			Reset()
+			loadYAML("base.yaml", []byte("server:\n  host: localhost\n  port: 8080\ntags: [a, b]\n"))
+			Set("env", "dev")
+			err := validateSchemaURI(context.Background(), "test/config/schema.json")
+			It("should pass", func() {
+				Expect(err).Should(BeNil())
+			})
+		})
+
+		Context("string values from env variables", func() {
+			Reset()
+			Set("server:port", "8080")
+			err := validateSchemaURI(context.Background(), "test/config/schema.json")
+			It("should pass if they parse", func() {
+				Expect(err).Should(BeNil())
+			})
+		})
+
+		Context("invalid config", func() {
+			Reset()
+			loadYAML("base.yaml", []byte(`server:
+  host: ""
+  port: 8080
+  mode: ftp
+  timeout: 30
+  tiemout: 90
+environment:
+  prod:
+    server:
+      timeout: 120
+`))
+			Set("env", "prod")
+			setEnvironment()
+			err := validateSchemaURI(context.Background(), "test/config/schema.json")
+			Set("env", "dev")
+			setEnvironment()
+			It("should report every problem with its position", func() {
+				Expect(err).ShouldNot(BeNil())
+				Expect(err.Error()).Should(Equal(`base.yaml:2:3: server:host: must be at least 1 characters long
+base.yaml:4:3: server:mode: must be one of http, https
+base.yaml:6:3: server:tiemout: is not a known key, did you mean "timeout"?
+base.yaml:10:7: server:timeout: must be at most 60`))
+			})
+		})
+
+		Context("missing required keys", func() {
+			Reset()
+			Set("tags", []interface{}{"a", 1})
+			err := ValidateSchema([]byte(`{"required": ["server"], "properties": {"tags": {"items": {"type": "string"}}}}`))
+			It("should report them", func() {
+				Expect(err).ShouldNot(BeNil())
+				Expect(err.Error()).Should(Equal("server: is required\ntags[1]: must be of type string"))
+			})
+		})
+
+	})
+
+	Describe("declared options", func() {
+
+		Reset()
+		resetOptions()
+		Define("server:port", 8080, "HTTP listen port", EnvName("TEST_PORT"), Alias("listen"))
+		Define("server:host", "localhost", "HTTP listen host")
+		Define("server:timeout", 30*time.Second, "request timeout")
+		Define("debug", false, "verbose logging")
+		Define("ratio", 0.5, "sampling ratio")
+
+		Context("defaults", func() {
+			Reset()
+			Set("server:host", "example.com")
+			err := applyOptions()
+			port := GetInt("server:port")
+			host := Get("server:host")
+			timeout := GetDuration("server:timeout")
+			debug := GetAny("debug")
+			ratio := GetFloat("ratio")
+			It("should fill in unset keys only", func() {
+				Expect(err).Should(BeNil())
+				Expect(port).Should(Equal(8080))
+				Expect(host).Should(Equal("example.com"))
+				Expect(timeout).Should(Equal(30 * time.Second))
+				Expect(debug).Should(Equal(false))
+				Expect(ratio).Should(Equal(0.5))
+			})
+		})
+
+		Context("env and flag values", func() {
+			Reset()
+			os.Setenv("TEST_PORT", "9090")
+			loadOptionEnvNames()
+			os.Unsetenv("TEST_PORT")
+			Set("debug", "true")
+			err := applyOptions()
+			port := GetAny("server:port")
+			debug := GetAny("debug")
+			It("should be converted to the option type", func() {
+				Expect(err).Should(BeNil())
+				Expect(port).Should(Equal(9090))
+				Expect(debug).Should(Equal(true))
+			})
+		})
+
+		Context("invalid values", func() {
+			Reset()
+			os.Setenv("TEST_PORT", "http")
+			loadOptionEnvNames()
+			os.Unsetenv("TEST_PORT")
+			Set("server:timeout", "soon")
+			err := applyOptions()
+			It("should fail, citing the source", func() {
+				Expect(err).ShouldNot(BeNil())
+				Expect(err.Error()).Should(Equal("env TEST_PORT: invalid value http for server:port: expected int\n" +
+					"set at runtime: invalid value soon for server:timeout: expected duration"))
+			})
+		})
+
+		Context("overlay values", func() {
+			Reset()
+			previous := environment
+			environment = "prod"
+			Set("environment:prod:server:port", "9443")
+			validErr := applyOptions()
+			port := GetAny("server:port")
+			Set("environment:prod:server:port", "abc")
+			invalidErr := applyOptions()
+			environment = previous
+			Reset()
+			It("should be converted to the option type", func() {
+				Expect(validErr).Should(BeNil())
+				Expect(port).Should(Equal(9443))
+			})
+			It("should fail when invalid", func() {
+				Expect(invalidErr).ShouldNot(BeNil())
+				Expect(invalidErr.Error()).Should(Equal("set at runtime: invalid value abc for environment:prod:server:port: expected int"))
+			})
+		})
+
+		Context("aliases", func() {
+			aliased := optionForFlag("listen")
+			other := optionForFlag("other")
+			It("should resolve to the option key", func() {
+				Expect(aliased).Should(Equal("server:port"))
+				Expect(other).Should(Equal("other"))
+			})
+		})
+
+		Context("help", func() {
+			os.Args = []string{"prog", "--help"}
+			requested := helpRequested()
+			os.Args = []string{"prog"}
+			usage := Usage()
+			It("should be detected", func() {
+				Expect(requested).Should(BeTrue())
+			})
+			It("should list every flag and env variable", func() {
+				Expect(usage).Should(ContainSubstring("--server:port=<int>, --listen"))
+				Expect(usage).Should(ContainSubstring("HTTP listen port (default 8080; env CONFIG_SERVER__PORT, TEST_PORT)"))
+				Expect(usage).Should(ContainSubstring("--server:timeout=<duration>"))
+			})
+		})
+
+		resetOptions()
+
+	})
+
+	Describe("unknown keys", func() {
+
+		Reset()
+		resetOptions()
+		Define("server:port", 8080, "HTTP listen port")
+		loadYAML("base.yaml", []byte("log:\n  level: info\nenvironment:\n  prod:\n    cache:\n      size: 1\n"))
+		known := knownKeys()
+
+		Context("known keys", func() {
+			It("should include options, file keys and their overrides", func() {
+				Expect(isKnownKey("server:port", known)).Should(BeTrue())
+				Expect(isKnownKey("server", known)).Should(BeTrue())
+				Expect(isKnownKey("log:level", known)).Should(BeTrue())
+				Expect(isKnownKey("environment:prod:server:port", known)).Should(BeTrue())
+				Expect(isKnownKey("cache:size", known)).Should(BeTrue())
+				Expect(isKnownKey("env", known)).Should(BeTrue())
+				Expect(isKnownKey("prot", known)).Should(BeFalse())
+			})
+		})
+
+		Context("unknown flag and env variable", func() {
+			os.Args = []string{"prog", "--prot=8080", "--log:levle=debug", "--server:port=1"}
+			os.Setenv("CONFIG_SERVER__PROT", "80")
+			clearWarnings()
+			warnErr := checkUnknownKeys(known)
+			var warnings []string
+			for _, warning := range Warnings() {
+				warnings = append(warnings, warning.Error())
+			}
+			UnknownKeys = FailUnknownKeys
+			failErr := checkUnknownKeys(known)
+			UnknownKeys = WarnUnknownKeys
+			os.Unsetenv("CONFIG_SERVER__PROT")
+			os.Args = []string{"prog"}
+
+			It("should warn by default, with suggestions", func() {
+				Expect(warnErr).Should(BeNil())
+				Expect(warnings).Should(ContainElement("unknown env variable CONFIG_SERVER__PROT, did you mean CONFIG_SERVER__PORT?"))
+				Expect(warnings).Should(ContainElement("unknown flag --prot, did you mean --server:port?"))
+				Expect(warnings).Should(ContainElement("unknown flag --log:levle, did you mean --log:level?"))
+				Expect(warnings).ShouldNot(ContainElement(ContainSubstring("--server:port,")))
+			})
+
+			It("should fail when asked to", func() {
+				Expect(failErr).ShouldNot(BeNil())
+				Expect(failErr.Error()).Should(ContainSubstring("unknown flag --prot"))
+			})
+		})
+
+		resetOptions()
+
 	})
 
+	Describe("shell completion", func() {
+
+		Reset()
+		resetOptions()
+		setDeclaredSchema(nil)
+		Define("server:mode", "http", "Listen mode", Enum("http", "https"))
+		Define("debug", false, "Verbose logging")
+		loadYAML("base.yaml", []byte("sub:\n  h: x\nenvironment:\n  prod:\n    cache:\n      size: 1\n"))
+		keys, values := completionKeys()
+		bash, bashErr := CompletionScript("bash", "my-app")
+		zsh, _ := CompletionScript("zsh", "my-app")
+		fish, _ := CompletionScript("fish", "my-app")
+		_, unsupportedErr := CompletionScript("tcsh", "my-app")
+		ValidateSchema([]byte(`{"properties": {"log": {"properties": {"level": {"enum": ["debug", "info"]}}}}}`))
+		schemaKeys, schemaValues := completionKeys()
+		setDeclaredSchema(nil)
+		resetOptions()
+
+		It("should complete nested keys", func() {
+			Expect(keys).Should(Equal([]string{"cache", "cache:size", "debug", "server", "server:mode", "sub", "sub:h"}))
+		})
+
+		It("should complete enum and bool values", func() {
+			Expect(values["server:mode"]).Should(Equal([]string{"http", "https"}))
+			Expect(values["debug"]).Should(Equal([]string{"true", "false"}))
+		})
+
+		It("should generate scripts for each shell", func() {
+			Expect(bashErr).Should(BeNil())
+			Expect(bash).Should(ContainSubstring("complete -o nospace -F _my_app_config 'my-app'"))
+			Expect(bash).Should(ContainSubstring("--server:mode=*)"))
+			Expect(zsh).Should(ContainSubstring("compdef _my_app_config 'my-app'"))
+			Expect(fish).Should(ContainSubstring("complete -c 'my-app' -l 'server:mode' -x -a 'http https' -d 'Listen mode'"))
+		})
+
+		It("should reject unknown shells", func() {
+			Expect(unsupportedErr).ShouldNot(BeNil())
+		})
+
+		It("should complete keys and enums of the schema", func() {
+			Expect(schemaKeys).Should(ContainElement("log:level"))
+			Expect(schemaValues["log:level"]).Should(Equal([]string{"debug", "info"}))
+		})
+
+		Context("requested while loading", func() {
+			Reset()
+			resetOptions()
+			resetSecretProviders()
+			Define("debug", false, "Verbose logging")
+			dir, _ := ioutil.TempDir("", "completion")
+			source := filepath.Join(dir, "app.yaml")
+			ioutil.WriteFile(source, []byte("db:\n  password: secret://vault/db\n"), 0600)
+			os.Setenv("CONFIG_URI", source)
+			os.Setenv("CONFIG_SCHEMA", "test/config/schema.json")
+			os.Args = []string{"prog", "--completion", "bash"}
+			UnknownKeys = FailUnknownKeys
+			previousOutput := HelpOutput
+			var out bytes.Buffer
+			HelpOutput = &out
+			err := Load()
+			HelpOutput = previousOutput
+			UnknownKeys = WarnUnknownKeys
+			os.Args = []string{"prog"}
+			os.Unsetenv("CONFIG_URI")
+			os.Unsetenv("CONFIG_SCHEMA")
+			os.RemoveAll(dir)
+			keys, _ := completionKeys()
+			setDeclaredSchema(nil)
+			resetOptions()
+			Reset()
+
+			It("should print the script before checking the config", func() {
+				Expect(err).Should(Equal(ErrHelp))
+				Expect(out.String()).Should(ContainSubstring("--db:password"))
+				Expect(out.String()).Should(ContainSubstring("--server:port"))
+			})
+
+			It("should not complete the completion flag itself", func() {
+				Expect(keys).ShouldNot(ContainElement("completion"))
+			})
+		})
+
+	})
+
+	Describe("flag sets", func() {
+
+		Context("bound flag set", func() {
+			Reset()
+			resetFlagBindings()
+			fs := flag.NewFlagSet("prog", flag.ContinueOnError)
+			fs.Int("port", 8080, "listen port")
+			fs.Bool("verbose", false, "verbose logging")
+			fs.Duration("timeout", time.Second, "timeout")
+			fs.Parse([]string{"-port=9090"})
+			BindFlagSet(fs, "server")
+			Set("server:timeout", "5s")
+			Set("server:port", 1)
+			loadFlagSets()
+			port := GetAny("server:port")
+			timeout := Get("server:timeout")
+			verbose := GetAny("server:verbose")
+			remaining := withoutBoundFlags([]string{"--port", "1", "-verbose", "--config=x", "--timeout=1s", "rest"})
+			resetFlagBindings()
+
+			It("should override with explicitly set flags", func() {
+				Expect(port).Should(Equal(9090))
+			})
+			It("should not override with flag defaults", func() {
+				Expect(timeout).Should(Equal("5s"))
+			})
+			It("should fill in unset keys with flag defaults", func() {
+				Expect(verbose).Should(Equal(false))
+			})
+			It("should leave bound flags out of config args", func() {
+				Expect(remaining).Should(Equal([]string{"--config=x", "rest"}))
+			})
+		})
+
+		Context("bound pflag set", func() {
+			Reset()
+			resetFlagBindings()
+			fs := pflag.NewFlagSet("prog", pflag.ContinueOnError)
+			fs.IntP("port", "p", 8080, "listen port")
+			fs.String("host", "localhost", "listen host")
+			fs.Parse([]string{"-p", "9090"})
+			BindPFlagSet(fs, "")
+			Set("host", "example.com")
+			loadFlagSets()
+			port := GetAny("port")
+			host := Get("host")
+			resetFlagBindings()
+
+			It("should apply set flags and keep lower layers", func() {
+				Expect(port).Should(Equal(9090))
+				Expect(host).Should(Equal("example.com"))
+			})
+		})
+
+		Context("generated flag set", func() {
+			Reset()
+			Set("server:port", 8080)
+			Set("debug", true)
+			fs := NewFlagSet("prog", flag.ContinueOnError)
+			err := fs.Parse([]string{"-server:port=9090", "-debug=false"})
+			port := GetInt("server:port")
+			debug := Get("debug")
+			It("should set config keys", func() {
+				Expect(err).Should(BeNil())
+				Expect(port).Should(Equal(9090))
+				Expect(debug).Should(Equal("false"))
+			})
+		})
+
+	})
+
+	Describe("positional args", func() {
+
+		Context("around flags", func() {
+			parsed := parseArgs([]string{"in.txt", "--a=1", "b", "--d", "w", "x", "-e=u", "y"})
+			It("should keep positionals in order", func() {
+				Expect(parsed.positionals).Should(Equal([]string{"in.txt", "b", "x", "y"}))
+			})
+			It("should not assign positionals to flags", func() {
+				Expect(parsed.pairs).Should(Equal([]argPair{{"a", "1"}, {"d", "w"}, {"e", "u"}}))
+			})
+		})
+
+		Context("end of options", func() {
+			parsed := parseArgs([]string{"--a", "--", "--b", "-c", "d"})
+			It("should treat everything after -- as positional", func() {
+				Expect(parsed.pairs).Should(Equal([]argPair{{"a", "true"}}))
+				Expect(parsed.positionals).Should(Equal([]string{"--b", "-c", "d"}))
+			})
+		})
+
+		Context("bool flags", func() {
+			resetOptions()
+			Define("debug", false, "Verbose logging")
+			fs := flag.NewFlagSet("prog", flag.ContinueOnError)
+			fs.Bool("quiet", false, "no output")
+			BindFlagSet(fs, "")
+			parsed := parseArgs([]string{"--debug", "input.txt", "--quiet", "output.txt", "--name", "x"})
+			os.Args = []string{"prog", "--debug", "input.txt"}
+			args := Args()
+			os.Args = []string{"prog"}
+			resetFlagBindings()
+			resetOptions()
+			It("should not take the next arg as their value", func() {
+				Expect(parsed.pairs).Should(Equal([]argPair{{"debug", "true"}, {"quiet", "true"}, {"name", "x"}}))
+				Expect(parsed.positionals).Should(Equal([]string{"input.txt", "output.txt"}))
+				Expect(args).Should(Equal([]string{"input.txt"}))
+			})
+		})
+
+		Context("subcommand", func() {
+			resetCommands()
+			Commands("migrate")
+			parsed := parseArgs([]string{"migrate", "up", "--migrate:dry-run"})
+			unknown := parseArgs([]string{"serve", "--a"})
+			os.Args = []string{"prog", "migrate", "up", "--migrate:dry-run"}
+			Reset()
+			loadCommandLineArgs()
+			command := Get("command")
+			dryRun := Get("migrate:dry-run")
+			args := Args()
+			os.Args = []string{"prog"}
+			resetCommands()
+
+			It("should recognize declared subcommands", func() {
+				Expect(parsed.command).Should(Equal("migrate"))
+				Expect(parsed.positionals).Should(Equal([]string{"up"}))
+				Expect(unknown.command).Should(Equal(""))
+				Expect(unknown.positionals).Should(Equal([]string{"serve"}))
+			})
+			It("should expose the command and its keys", func() {
+				Expect(command).Should(Equal("migrate"))
+				Expect(dryRun).Should(Equal("true"))
+				Expect(args).Should(Equal([]string{"up"}))
+			})
+		})
+
+	})
+
+	Describe("typed flags", func() {
+
+		Context("booleans", func() {
+			Reset()
+			resetOptions()
+			Define("no-cache", false, "disable the cache")
+			Set("verbose", true)
+			os.Args = []string{"prog", "--no-verbose", "--debug", "--tls=False", "-q", "--no-cache", "--name=true"}
+			loadCommandLineArgs()
+			os.Args = []string{"prog"}
+			resetOptions()
+			verbose := GetAny("verbose")
+			debug := GetAny("debug")
+			tls := GetAny("tls")
+			quiet := GetAny("q")
+			noCache := GetAny("no-cache")
+			It("should negate --no- flags", func() {
+				Expect(verbose).Should(Equal(false))
+			})
+			It("should make bare flags true", func() {
+				Expect(debug).Should(Equal(true))
+				Expect(quiet).Should(Equal(true))
+			})
+			It("should parse true and false", func() {
+				Expect(tls).Should(Equal(false))
+			})
+			It("should leave declared no- options alone", func() {
+				Expect(noCache).Should(Equal(true))
+			})
+		})
+
+		Context("numbers", func() {
+			plain := argValue("8080")
+			InferFlagTypes = true
+			port := argValue("8080")
+			negative := argValue("-1")
+			ratio := argValue("0.25")
+			mode := argValue("0755")
+			version := argValue("1.2.3")
+			InferFlagTypes = false
+			It("should stay strings by default", func() {
+				Expect(plain).Should(Equal("8080"))
+			})
+			It("should be inferred when asked to", func() {
+				Expect(port).Should(Equal(8080))
+				Expect(negative).Should(Equal(-1))
+				Expect(ratio).Should(Equal(0.25))
+				Expect(mode).Should(Equal("0755"))
+				Expect(version).Should(Equal("1.2.3"))
+			})
+		})
+
+	})
+
+	Describe("short flags", func() {
+
+		Reset()
+		resetOptions()
+		resetShortFlags()
+		Define("server:port", 8080, "HTTP listen port", Short('p'))
+		CountFlag('v', "log:verbosity")
+		ShortFlag('n', "name")
+		os.Args = []string{"prog", "-vvp", "9090", "-v", "-n=x", "-a"}
+		loadCommandLineArgs()
+		os.Args = []string{"prog"}
+		port := Get("server:port")
+		verbosity := GetAny("log:verbosity")
+		name := Get("name")
+		other := GetAny("a")
+		portPos, _ := PositionOf("server:port")
+		usage := Usage()
+		resetShortFlags()
+		resetOptions()
+
+		It("should map short flags to their keys", func() {
+			Expect(port).Should(Equal("9090"))
+			Expect(name).Should(Equal("x"))
+			Expect(portPos.String()).Should(Equal("flag -p"))
+		})
+
+		It("should count repeated flags", func() {
+			Expect(verbosity).Should(Equal(3))
+		})
+
+		It("should keep unregistered short flags", func() {
+			Expect(other).Should(Equal(true))
+		})
+
+		It("should list short flags in the usage", func() {
+			Expect(usage).Should(ContainSubstring("-p, --server:port=<int>"))
+		})
+
+		Context("counted flags before positionals", func() {
+			Reset()
+			CountFlag('v', "log:verbosity")
+			os.Args = []string{"prog", "-vvv", "input.txt"}
+			loadCommandLineArgs()
+			verbosity := GetAny("log:verbosity")
+			args := Args()
+			os.Args = []string{"prog"}
+			resetShortFlags()
+			Reset()
+			It("should not take a value", func() {
+				Expect(verbosity).Should(Equal(3))
+				Expect(args).Should(Equal([]string{"input.txt"}))
+			})
+		})
+
+	})
+
+	Describe("env prefixes", func() {
+
+		Context("prefix list", func() {
+			Reset()
+			EnvPrefixes = []string{"MYAPP", "CONFIG"}
+			os.Setenv("MYAPP_SERVER__PORT", "9090")
+			os.Setenv("CONFIG_SERVER__PORT", "8080")
+			os.Setenv("CONFIG_SERVER__HOST", "localhost")
+			loadEnvironmentVariables()
+			port := Get("server:port")
+			host := Get("server:host")
+			portPos, _ := PositionOf("server:port")
+			name := envVarName("server:port")
+			EnvPrefixes = nil
+			os.Unsetenv("MYAPP_SERVER__PORT")
+			os.Unsetenv("CONFIG_SERVER__PORT")
+			os.Unsetenv("CONFIG_SERVER__HOST")
+
+			It("should prefer earlier prefixes", func() {
+				Expect(port).Should(Equal("9090"))
+				Expect(portPos.String()).Should(Equal("env MYAPP_SERVER__PORT"))
+				Expect(host).Should(Equal("localhost"))
+				Expect(name).Should(Equal("MYAPP_SERVER__PORT"))
+			})
+		})
+
+		Context("single underscore separator", func() {
+			Reset()
+			EnvSeparator = "_"
+			os.Setenv("CONFIG_DB_HOST", "db.local")
+			loadEnvironmentVariables()
+			host := Get("db:host")
+			name := envVarName("db:host")
+			EnvSeparator = "__"
+			os.Unsetenv("CONFIG_DB_HOST")
+
+			It("should nest on the separator", func() {
+				Expect(host).Should(Equal("db.local"))
+				Expect(name).Should(Equal("CONFIG_DB_HOST"))
+			})
+		})
+
+		Context("bound env variables", func() {
+			Reset()
+			resetEnvBindings()
+			BindEnv("DATABASE_URL", "db:url")
+			os.Setenv("DATABASE_URL", "postgres://db")
+			loadEnvironmentVariables()
+			url := Get("db:url")
+			urlPos, _ := PositionOf("db:url")
+			known := isKnownKey("db:url", knownKeys())
+			resetEnvBindings()
+			os.Unsetenv("DATABASE_URL")
+
+			It("should set the bound key", func() {
+				Expect(url).Should(Equal("postgres://db"))
+				Expect(urlPos.String()).Should(Equal("env DATABASE_URL"))
+				Expect(known).Should(BeTrue())
+			})
+		})
+
+	})
+
+	Describe("env values", func() {
+
+		Context("json object", func() {
+			Reset()
+			os.Setenv("CONFIG_DB", `{"host": "db.local", "port": 5432}`)
+			loadEnvironmentVariables()
+			host := Get("db:host")
+			os.Unsetenv("CONFIG_DB")
+
+			It("should be set as JSON", func() {
+				Expect(isJSON(`{"a": 1}`)).Should(BeTrue())
+				Expect(isJSON(`{"a": 1`)).Should(BeFalse())
+				Expect(host).Should(Equal("db.local"))
+			})
+		})
+
+		Context("coercion", func() {
+			Reset()
+			os.Setenv("CONFIG_PORT", "8080")
+			os.Setenv("CONFIG_DEBUG", "true")
+			os.Setenv("CONFIG_RATIO", "0.5")
+			os.Setenv("CONFIG_MODE", "0755")
+			os.Setenv("CONFIG_NAME", "on")
+			loadEnvironmentVariables()
+			plain := GetAny("port")
+			CoerceEnv = true
+			loadEnvironmentVariables()
+			CoerceEnv = false
+			port := GetAny("port")
+			debug := GetAny("debug")
+			ratio := GetAny("ratio")
+			mode := GetAny("mode")
+			name := GetAny("name")
+			for _, name := range []string{"PORT", "DEBUG", "RATIO", "MODE", "NAME"} {
+				os.Unsetenv("CONFIG_" + name)
+			}
+
+			It("should keep strings by default", func() {
+				Expect(plain).Should(Equal("8080"))
+			})
+
+			It("should type YAML scalars when asked to", func() {
+				Expect(port).Should(Equal(8080))
+				Expect(debug).Should(Equal(true))
+				Expect(ratio).Should(Equal(0.5))
+				Expect(mode).Should(Equal("0755"))
+				Expect(name).Should(Equal("on"))
+			})
+		})
+
+		Context("forced structure", func() {
+			Reset()
+			os.Setenv("CONFIG_SERVERS__JSON", `["a", "b"]`)
+			os.Setenv("CONFIG_LIMITS__YAML", "cpu: 2\nmemory: 1Gi")
+			os.Setenv("CONFIG_BROKEN__JSON", "{")
+			loadEnvironmentVariables()
+			servers := GetAny("servers")
+			cpu := GetAny("limits:cpu")
+			pos, _ := PositionOf("limits")
+			broken := GetAny("broken")
+			var warnings []string
+			for _, warning := range Warnings() {
+				warnings = append(warnings, warning.Error())
+			}
+			os.Unsetenv("CONFIG_SERVERS__JSON")
+			os.Unsetenv("CONFIG_LIMITS__YAML")
+			os.Unsetenv("CONFIG_BROKEN__JSON")
+
+			It("should parse the value", func() {
+				Expect(servers).Should(Equal([]interface{}{"a", "b"}))
+				Expect(cpu).Should(Equal(2))
+				Expect(pos.String()).Should(Equal("env CONFIG_LIMITS__YAML"))
+			})
+
+			It("should warn about invalid values", func() {
+				Expect(warnings).Should(ContainElement(ContainSubstring("env CONFIG_BROKEN__JSON")))
+				Expect(broken).Should(BeNil())
+			})
+		})
+
+	})
+
+	Describe("env files", func() {
+
+		dir, _ := ioutil.TempDir("", "config-secrets")
+		password := filepath.Join(dir, "db")
+		ioutil.WriteFile(password, []byte("s3cret\n"), 0400)
+		writable := filepath.Join(dir, "writable")
+		ioutil.WriteFile(writable, []byte("x"), 0600)
+		os.Chmod(writable, 0666)
+		large := filepath.Join(dir, "large")
+		ioutil.WriteFile(large, make([]byte, 100), 0600)
+
+		Reset()
+		resetSensitive()
+		MarkSensitive("cert")
+		MarkSensitive("key")
+		SecretFileMaxSize = 64
+		os.Setenv("CONFIG_DB__PASSWORD_FILE", password)
+		os.Setenv("CONFIG_API__TOKEN_FILE", writable)
+		os.Setenv("CONFIG_CERT_FILE", large)
+		os.Setenv("CONFIG_KEY_FILE", filepath.Join(dir, "missing"))
+		os.Setenv("CONFIG_LOG__FILE", "/tmp/app.log")
+		os.Setenv("CONFIG_AUDIT_FILE", "/tmp/audit.log")
+		dollar := filepath.Join(dir, "dollar")
+		ioutil.WriteFile(dollar, []byte("p$${x}w${HOME}${a:b}"), 0400)
+		os.Setenv("CONFIG_DB__ADMIN_PASSWORD_FILE", dollar)
+		MarkSensitive("db:admin_password")
+		loadEnvironmentVariables()
+		dollarValue := GetAny("db:admin_password")
+		checkErr := checkTemplates()
+		logFile := GetAny("log:file")
+		auditFile := GetAny("audit_file")
+		audit := GetAny("audit")
+		SecretFileMaxSize = 64 << 10
+		value := GetAny("db:password")
+		pos, _ := PositionOf("db:password")
+		sensitive := IsSensitive("db:password")
+		overlaySensitive := IsSensitive("environment:prod:db:password")
+		token := GetAny("api:token")
+		var warnings []string
+		for _, warning := range Warnings() {
+			warnings = append(warnings, warning.Error())
+		}
+		for _, name := range []string{"DB__PASSWORD", "DB__ADMIN_PASSWORD", "API__TOKEN", "CERT", "KEY", "LOG_", "AUDIT"} {
+			os.Unsetenv("CONFIG_" + name + "_FILE")
+		}
+		resetSensitive()
+		os.RemoveAll(dir)
+
+		It("should read the value from the file", func() {
+			Expect(value).Should(Equal("s3cret"))
+			Expect(pos.String()).Should(Equal("env CONFIG_DB__PASSWORD_FILE"))
+		})
+
+		It("should not expand the value", func() {
+			Expect(dollarValue).Should(Equal("p$${x}w${HOME}${a:b}"))
+			Expect(checkErr).Should(BeNil())
+		})
+
+		It("should mark the value as sensitive", func() {
+			Expect(sensitive).Should(BeTrue())
+			Expect(overlaySensitive).Should(BeTrue())
+		})
+
+		It("should only read files for sensitive keys", func() {
+			Expect(logFile).Should(Equal("/tmp/app.log"))
+			Expect(auditFile).Should(Equal("/tmp/audit.log"))
+			Expect(audit).Should(BeNil())
+			Expect(warnings).ShouldNot(ContainElement(ContainSubstring("CONFIG_LOG__FILE")))
+		})
+
+		It("should reject files over the limits", func() {
+			Expect(token).Should(BeNil())
+			Expect(warnings).Should(ContainElement(ContainSubstring("CONFIG_API__TOKEN_FILE")))
+			Expect(warnings).Should(ContainElement(ContainSubstring("larger than 64 bytes")))
+			Expect(warnings).Should(ContainElement(ContainSubstring("CONFIG_KEY_FILE")))
+		})
+
+	})
+
+	Describe("secret providers", func() {
+
+		dir, _ := ioutil.TempDir("", "config-secrets")
+		ioutil.WriteFile(filepath.Join(dir, "db"), []byte(`{"user": "app", "password": "pw"}`), 0600)
+		ioutil.WriteFile(filepath.Join(dir, "token"), []byte("t0ken\n"), 0600)
+
+		Reset()
+		resetSensitive()
+		resetSecretProviders()
+		RegisterSecretProvider("file", FileSecretProvider{Dir: dir})
+		loadYAML("base.yaml", []byte(`db:
+  password: secret://file/db#password
+  url: postgres://${secret:file:db#user}:${secret:file:db#password}@db.local/app
+api:
+  token: secret://file/token
+  name: public
+`))
+		resolveErr := resolveSecrets(context.Background())
+		password := Get("db:password")
+		url := Get("db:url")
+		token := Get("api:token")
+		sensitive := IsSensitive("db:url")
+		dump := ToYAML() + ToGo()
+
+		// cached secrets survive changes until they expire
+		ioutil.WriteFile(filepath.Join(dir, "token"), []byte("changed"), 0600)
+		Set("api:token", "secret://file/token")
+		resolveSecrets(context.Background())
+		cachedToken := Get("api:token")
+
+		loadYAML("bad.yaml", []byte("api:\n  key: secret://file/missing\n"))
+		Set("api:token", "secret://vault/kv/token")
+		Set("api:escape", "secret://file/../../etc/passwd")
+		failErr := resolveSecrets(context.Background())
+
+		resetSecretProviders()
+		resetSensitive()
+		os.RemoveAll(dir)
+
+		It("should resolve secret references", func() {
+			Expect(resolveErr).Should(BeNil())
+			Expect(password).Should(Equal("pw"))
+			Expect(url).Should(Equal("postgres://app:pw@db.local/app"))
+			Expect(token).Should(Equal("t0ken"))
+		})
+
+		It("should keep secrets out of dumps", func() {
+			Expect(sensitive).Should(BeTrue())
+			Expect(dump).ShouldNot(ContainSubstring("pw"))
+			Expect(dump).ShouldNot(ContainSubstring("t0ken"))
+			Expect(dump).Should(ContainSubstring(RedactedValue))
+			Expect(dump).Should(ContainSubstring("public"))
+		})
+
+		It("should cache resolved secrets", func() {
+			Expect(cachedToken).Should(Equal("t0ken"))
+		})
+
+		It("should report unresolvable references", func() {
+			Expect(failErr).ShouldNot(BeNil())
+			Expect(failErr.Error()).Should(ContainSubstring(`api:token: secret secret://vault/kv/token: unknown secret provider "vault"`))
+			Expect(failErr.Error()).Should(ContainSubstring("bad.yaml:2:3: api:key"))
+			Expect(failErr.Error()).Should(ContainSubstring("api:escape"))
+		})
+
+		Context("holding ${", func() {
+			dir, _ := ioutil.TempDir("", "config-secrets")
+			ioutil.WriteFile(filepath.Join(dir, "db"), []byte("p$${x}w${HOME}${a:b}"), 0600)
+			Reset()
+			resetSensitive()
+			resetSecretProviders()
+			RegisterSecretProvider("file", FileSecretProvider{Dir: dir})
+			loadYAML("base.yaml", []byte("db:\n  password: secret://file/db\n  url: ${HOME}/${secret:file:db}\n"))
+			resolveErr := resolveSecrets(context.Background())
+			password := Get("db:password")
+			url := Get("db:url")
+			checkErr := checkTemplates()
+			resetSecretProviders()
+			resetSensitive()
+			Reset()
+			os.RemoveAll(dir)
+
+			It("should not expand the secret", func() {
+				Expect(resolveErr).Should(BeNil())
+				Expect(checkErr).Should(BeNil())
+				Expect(password).Should(Equal("p$${x}w${HOME}${a:b}"))
+				Expect(url).Should(Equal(os.Getenv("HOME") + "/p$${x}w${HOME}${a:b}"))
+			})
+		})
+
+	})
+
+	Describe("redaction", func() {
+
+		Reset()
+		resetSensitive()
+		loadYAML("base.yaml", []byte(`db:
+  host: db.local
+  password: hunter2
+api:
+  key: !secret abc123
+  hosts: [a.example, !secret b.example]
+servers:
+  - name: edge
+    cert: !secret pem-data
+auth_token: tok3n
+`))
+		MarkSensitive("license")
+		Set("license", "L-12345")
+		key := Get("api:key")
+		dumps := []string{ToYAML(), ToGo(), fmt.Sprint(GetAll()), Explain("db:password")}
+		unredacted := ToYAMLUnredacted()
+		_, listKeyPos := PositionOf("name")
+		resetSensitive()
+
+		It("should mask sensitive keys in every dump", func() {
+			for _, dump := range dumps {
+				for _, secret := range []string{"hunter2", "abc123", "b.example", "pem-data", "tok3n", "L-12345"} {
+					Expect(dump).ShouldNot(ContainSubstring(secret))
+				}
+				Expect(dump).Should(ContainSubstring(RedactedValue))
+			}
+			Expect(dumps[0]).Should(ContainSubstring("db.local"))
+			Expect(dumps[0]).Should(ContainSubstring("edge"))
+			Expect(dumps[3]).Should(HavePrefix("db:password = " + RedactedValue))
+		})
+
+		It("should keep the values readable", func() {
+			Expect(key).Should(Equal("abc123"))
+			Expect(unredacted).Should(ContainSubstring("hunter2"))
+			Expect(unredacted).Should(ContainSubstring("abc123"))
+		})
+
+		It("should not record keys in lists at the root", func() {
+			Expect(listKeyPos).Should(BeFalse())
+		})
+
+	})
+
+	Describe("encrypted documents", func() {
+
+		identity, _ := age.GenerateX25519Identity()
+		encrypt := func(plain string, armored bool) []byte {
+			var buf bytes.Buffer
+			var out io.Writer = &buf
+			var armorWriter io.WriteCloser
+			if armored {
+				armorWriter = armor.NewWriter(&buf)
+				out = armorWriter
+			}
+			w, _ := age.Encrypt(out, identity.Recipient())
+			io.WriteString(w, plain)
+			w.Close()
+			if armorWriter != nil {
+				armorWriter.Close()
+			}
+			return buf.Bytes()
+		}
+
+		Context("whole documents", func() {
+			Reset()
+			os.Setenv("CONFIG_AGE_KEY", identity.String())
+			binary, binaryErr := decryptDocument("app.yaml.age", encrypt("db:\n  host: db.local\n", false))
+			armored, armoredErr := decryptDocument("s3://us-west-2/b/app.yaml.age", encrypt("port: 80\n", true))
+			plain, _ := decryptDocument("app.yaml", []byte("port: 80\n"))
+			other, _ := age.GenerateX25519Identity()
+			os.Setenv("CONFIG_AGE_KEY", other.String())
+			_, wrongKeyErr := decryptDocument("app.yaml.age", encrypt("port: 80\n", false))
+			os.Unsetenv("CONFIG_AGE_KEY")
+			_, noKeyErr := decryptDocument("app.yaml.age", encrypt("port: 80\n", false))
+
+			It("should decrypt with the identity", func() {
+				Expect(binaryErr).Should(BeNil())
+				Expect(string(binary)).Should(Equal("db:\n  host: db.local\n"))
+				Expect(armoredErr).Should(BeNil())
+				Expect(string(armored)).Should(Equal("port: 80\n"))
+				Expect(string(plain)).Should(Equal("port: 80\n"))
+			})
+
+			It("should fail without the right identity", func() {
+				Expect(wrongKeyErr).ShouldNot(BeNil())
+				Expect(wrongKeyErr.Error()).Should(HavePrefix("app.yaml.age: could not decrypt"))
+				Expect(noKeyErr.Error()).Should(ContainSubstring("set CONFIG_AGE_KEY"))
+			})
+		})
+
+		Context("key variables", func() {
+			Reset()
+			resetOptions()
+			Define("port", 80, "Port")
+			dataKey := base64.StdEncoding.EncodeToString(make([]byte, 32))
+			os.Setenv("CONFIG_AGE_KEY", identity.String())
+			os.Setenv("CONFIG_AGE_KEY_FILE", "/run/secrets/age")
+			os.Setenv("CONFIG_DATA_KEY", dataKey)
+			os.Setenv("CONFIG_DATA_KEY_FILE", "/run/secrets/data")
+			loadEnvironmentVariables()
+			all := fmt.Sprint(GetAll())
+			dump := ToYAMLUnredacted()
+			clearWarnings()
+			unknownErr := checkUnknownKeys(knownKeys())
+			warnings := Warnings()
+			for _, name := range []string{"AGE_KEY", "AGE_KEY_FILE", "DATA_KEY", "DATA_KEY_FILE"} {
+				os.Unsetenv("CONFIG_" + name)
+			}
+			resetOptions()
+			Reset()
+
+			It("should not load them into the config", func() {
+				Expect(all).ShouldNot(ContainSubstring(identity.String()))
+				Expect(all).ShouldNot(ContainSubstring(dataKey))
+				Expect(dump).ShouldNot(ContainSubstring(identity.String()))
+				Expect(dump).ShouldNot(ContainSubstring("/run/secrets"))
+			})
+
+			It("should not report them as unknown", func() {
+				Expect(unknownErr).Should(BeNil())
+				Expect(warnings).Should(BeEmpty())
+			})
+		})
+
+		Context("encrypted values", func() {
+			key := make([]byte, 32)
+			rand.Read(key)
+			password, _ := EncryptValue("db:password", "hunter2", key)
+			port, _ := EncryptValue("DB:Port", 5432, key)
+			tampered := strings.Replace(password, "data:", "data:AAAA", 1)
+
+			Reset()
+			resetSensitive()
+			os.Setenv("CONFIG_DATA_KEY", base64.StdEncoding.EncodeToString(key))
+			loadErr := loadYAML("base.yaml", []byte("db:\n  password: "+password+"\n  port: "+port+"\n  host: db.local\n"))
+			tamperedErr := loadYAML("tampered.yaml", []byte("db:\n  password: "+tampered+"\n"))
+			movedErr := loadYAML("moved.yaml", []byte("api:\n  token: "+password+"\n"))
+			os.Unsetenv("CONFIG_DATA_KEY")
+			_, noKeyErr := decryptValue("db:password", password, nil)
+			noKeyLoadErr := loadYAML("nokey.yaml", []byte("db:\n  password: "+password+"\n"))
+			decrypted := Get("db:password")
+			decryptedPort := GetAny("db:port")
+			sensitive := IsSensitive("db:port")
+			resetSensitive()
+
+			It("should decrypt values to their type", func() {
+				Expect(loadErr).Should(BeNil())
+				Expect(password).Should(HavePrefix("ENC[AES256_GCM,data:"))
+				Expect(decrypted).Should(Equal("hunter2"))
+				Expect(decryptedPort).Should(Equal(5432))
+				Expect(sensitive).Should(BeTrue())
+			})
+
+			It("should reject tampered values and missing keys", func() {
+				Expect(tamperedErr).ShouldNot(BeNil())
+				Expect(tamperedErr.Error()).Should(HavePrefix("tampered.yaml:2:13: db:password: "))
+				Expect(movedErr).ShouldNot(BeNil())
+				Expect(movedErr.Error()).Should(HavePrefix("moved.yaml:2:10: api:token: could not decrypt value"))
+				Expect(noKeyErr).ShouldNot(BeNil())
+				Expect(noKeyLoadErr.Error()).Should(ContainSubstring("set CONFIG_DATA_KEY"))
+			})
+		})
+
+	})
+
+	Describe("signed sources", func() {
+
+		public, private, _ := ed25519.GenerateKey(rand.Reader)
+		_, otherPrivate, _ := ed25519.GenerateKey(rand.Reader)
+		doc := []byte("server:\n  port: 80\n")
+		files := make(map[string][]byte)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if data, ok := files[r.URL.Path]; ok {
+				w.Write(data)
+				return
+			}
+			http.NotFound(w, r)
+		}))
+		sign := func(path string, data []byte, key ed25519.PrivateKey) []byte {
+			return SignSource(server.URL+path, data, key)
+		}
+		files["/app.yaml"] = doc
+		files["/app.yaml.sig"] = []byte(base64.StdEncoding.EncodeToString(sign("/app.yaml", doc, private)))
+		files["/raw.yaml"] = doc
+		files["/raw.yaml.sig"] = sign("/raw.yaml", doc, private)
+		files["/tampered.yaml"] = []byte("server:\n  port: 81\n")
+		files["/tampered.yaml.sig"] = sign("/tampered.yaml", doc, private)
+		files["/other.yaml"] = doc
+		files["/other.yaml.sig"] = sign("/other.yaml", doc, otherPrivate)
+		files["/unsigned.yaml"] = doc
+		files["/unbound.yaml"] = doc
+		files["/unbound.yaml.sig"] = ed25519.Sign(private, doc)
+		// staging.yaml and its signature, copied to prod.yaml
+		files["/prod.yaml"] = doc
+		files["/prod.yaml.sig"] = sign("/staging.yaml", doc, private)
+
+		load := func(path string) ([]byte, error) {
+			loader, err := loaderForURI(server.URL + path)
+			if err != nil {
+				return nil, err
+			}
+			return fetch(context.Background(), server.URL+path, loader)
+		}
+
+		os.Setenv("CONFIG_TRUSTED_KEYS", base64.StdEncoding.EncodeToString(public))
+		signed, signedErr := load("/app.yaml?timeout=5s")
+		raw, rawErr := load("/raw.yaml")
+		_, tamperedErr := load("/tampered.yaml")
+		_, otherErr := load("/other.yaml")
+		_, unsignedErr := load("/unsigned.yaml")
+		_, unboundErr := load("/unbound.yaml")
+		_, swappedErr := load("/prod.yaml")
+
+		// signature failures don't fall back to the cache
+		cacheDir, _ := ioutil.TempDir("", "config-cache")
+		CacheDir = cacheDir
+		load("/app.yaml")
+		files["/app.yaml"] = files["/tampered.yaml"]
+		_, cachedTamperedErr := load("/app.yaml")
+		CacheDir = ""
+		os.RemoveAll(cacheDir)
+
+		// the keys are not config
+		Reset()
+		resetOptions()
+		Define("port", 80, "Port")
+		loadEnvironmentVariables()
+		trustedInTree := fmt.Sprint(GetAll())
+		clearWarnings()
+		unknownErr := checkUnknownKeys(knownKeys())
+		unknownWarnings := Warnings()
+		resetOptions()
+		Reset()
+
+		os.Setenv("CONFIG_TRUSTED_KEYS", "not-a-key")
+		_, badKeyErr := loaderForURI(server.URL + "/app.yaml")
+		os.Unsetenv("CONFIG_TRUSTED_KEYS")
+		untrusted, untrustedErr := load("/unsigned.yaml")
+		server.Close()
+
+		It("should load documents signed by a trusted key", func() {
+			Expect(signedErr).Should(BeNil())
+			Expect(signed).Should(Equal(doc))
+			Expect(rawErr).Should(BeNil())
+			Expect(raw).Should(Equal(doc))
+		})
+
+		It("should reject unsigned and tampered documents", func() {
+			var sigErr *SignatureError
+			Expect(errors.As(tamperedErr, &sigErr)).Should(BeTrue())
+			Expect(tamperedErr.Error()).Should(HaveSuffix("/tampered.yaml rejected: signature does not match any trusted key"))
+			Expect(otherErr).ShouldNot(BeNil())
+			Expect(unsignedErr.Error()).Should(ContainSubstring("/unsigned.yaml rejected: no signature at "))
+			Expect(cachedTamperedErr).ShouldNot(BeNil())
+		})
+
+		It("should reject documents signed for another source", func() {
+			Expect(swappedErr).ShouldNot(BeNil())
+			Expect(swappedErr.Error()).Should(HaveSuffix("/prod.yaml rejected: signature does not match any trusted key"))
+			Expect(unboundErr).ShouldNot(BeNil())
+		})
+
+		It("should keep the keys out of the config", func() {
+			Expect(trustedInTree).ShouldNot(ContainSubstring(base64.StdEncoding.EncodeToString(public)))
+			Expect(unknownErr).Should(BeNil())
+			Expect(unknownWarnings).Should(BeEmpty())
+		})
+
+		It("should check keys only when configured", func() {
+			Expect(badKeyErr).ShouldNot(BeNil())
+			Expect(untrustedErr).Should(BeNil())
+			Expect(untrusted).Should(Equal(doc))
+		})
+
+	})
+
+	Describe("yaml tags", func() {
+
+		Context("loading a document with tags", func() {
+			Reset()
+			resetSensitive()
+			resetSecretProviders()
+			secrets, _ := ioutil.TempDir("", "config-secrets")
+			ioutil.WriteFile(filepath.Join(secrets, "db.yaml"), []byte("token: abc123\n"), 0600)
+			RegisterSecretProvider("files", FileSecretProvider{Dir: secrets})
+			os.Setenv("CONFIG_INCLUDE_DB_HOST", "db.local")
+			source := "test/config/include/app.yaml"
+			data, _ := ioutil.ReadFile(source)
+			err := loadYAML(source, data)
+			secretErr := resolveSecrets(context.Background())
+			os.Unsetenv("CONFIG_INCLUDE_DB_HOST")
+			port := GetAny("server:port")
+			max := GetAny("server:limits:max")
+			portPos, _ := PositionOf("server:port")
+			maxPos, _ := PositionOf("server:limits:max")
+			host := GetAny("db:host")
+			token := GetAny("db:token")
+			plain := GetAny("db:plain")
+			tokenSensitive := IsSensitive("db:token")
+			plainSensitive := IsSensitive("db:plain")
+			Reset()
+			resetSensitive()
+			resetSecretProviders()
+			os.RemoveAll(secrets)
+
+			It("should include documents relative to the including one", func() {
+				Expect(err).Should(BeNil())
+				Expect(port).Should(Equal(8080))
+				Expect(max).Should(Equal(10))
+				Expect(portPos.String()).Should(Equal("test/config/include/server.yaml:2:1"))
+				Expect(maxPos.String()).Should(Equal("test/config/include/shared/limits.yaml:1:1"))
+			})
+
+			It("should read env variables", func() {
+				Expect(host).Should(Equal("db.local"))
+			})
+
+			It("should resolve secret:// references only", func() {
+				Expect(secretErr).Should(BeNil())
+				Expect(token).Should(Equal("abc123"))
+				Expect(tokenSensitive).Should(BeTrue())
+				Expect(plain).Should(Equal("files:db.yaml#token"))
+				Expect(plainSensitive).Should(BeTrue())
+			})
+		})
+
+		Context("reading files", func() {
+			Reset()
+			dir, _ := ioutil.TempDir("", "config-files")
+			ioutil.WriteFile(filepath.Join(dir, "db.password"), []byte("s3cret\n"), 0600)
+			ca := bytes.Repeat([]byte("x"), 100<<10)
+			ioutil.WriteFile(filepath.Join(dir, "ca.pem"), ca, 0600)
+			os.Chmod(filepath.Join(dir, "ca.pem"), 0664)
+			source := filepath.Join(dir, "app.yaml")
+			err := loadYAML(source, []byte("db:\n  password: !file db.password\n  ca: !file ca.pem\n"))
+			password := GetAny("db:password")
+			caValue := GetAny("db:ca")
+			missingErr := loadYAML(source, []byte("cert: !file missing.pem\n"))
+			os.RemoveAll(dir)
+			Reset()
+
+			It("should read files relative to the document", func() {
+				Expect(err).Should(BeNil())
+				Expect(password).Should(Equal("s3cret"))
+			})
+
+			It("should read large and group writable files", func() {
+				Expect(caValue).Should(Equal(string(ca)))
+			})
+
+			It("should fail on missing files", func() {
+				Expect(missingErr).ShouldNot(BeNil())
+				Expect(missingErr.Error()).Should(ContainSubstring("app.yaml:1:7: cert:"))
+			})
+		})
+
+		Context("loading a remote document", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/conf/ca.pem":
+					w.Write([]byte("remote ca\n"))
+				case "/shared/db.yaml":
+					w.Write([]byte("host: db.remote\n"))
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			Reset()
+			source := server.URL + "/conf/app.yaml"
+			err := loadYAML(source, []byte("ca: !file ca.pem\ndb: !include ../shared/db.yaml\n"))
+			ca := GetAny("ca")
+			db := GetAny("db:host")
+			dbPos, _ := PositionOf("db:host")
+			includeErr := loadYAML(source, []byte("a: !include /etc/hosts\n"))
+			fileErr := loadYAML(source, []byte("a: !file /etc/hostname\n"))
+			envErr := loadYAML(source, []byte("a: !env HOME\n"))
+			server.Close()
+			Reset()
+
+			It("should read files and documents relative to it", func() {
+				Expect(err).Should(BeNil())
+				Expect(ca).Should(Equal("remote ca"))
+				Expect(db).Should(Equal("db.remote"))
+				Expect(dbPos.String()).Should(Equal(server.URL + "/shared/db.yaml:1:1"))
+			})
+
+			It("should not read local files or env variables", func() {
+				Expect(includeErr.Error()).Should(Equal(source + ":1:4: remote documents cannot read local file /etc/hosts"))
+				Expect(fileErr.Error()).Should(Equal(source + ":1:4: a: remote documents cannot read local file /etc/hostname"))
+				Expect(envErr.Error()).Should(Equal(source + ":1:4: a: remote documents cannot read env variables"))
+			})
+		})
+
+		Context("including documents in a cycle", func() {
+			Reset()
+			source := "test/config/include/cycle-a.yaml"
+			data, _ := ioutil.ReadFile(source)
+			err := loadYAML(source, data)
+			missingSource := "test/config/include/missing.yaml"
+			missingData, _ := ioutil.ReadFile(missingSource)
+			missingErr := loadYAML(missingSource, missingData)
+			Reset()
+
+			It("should fail", func() {
+				Expect(err).ShouldNot(BeNil())
+				Expect(err.Error()).Should(Equal(
+					"test/config/include/cycle-b.yaml:1:4: include cycle test/config/include/cycle-a.yaml -> test/config/include/cycle-b.yaml -> test/config/include/cycle-a.yaml",
+				))
+			})
+
+			It("should fail on missing documents", func() {
+				Expect(missingErr).ShouldNot(BeNil())
+				Expect(missingErr.Error()).Should(ContainSubstring("include test/config/include/nope.yaml"))
+			})
+		})
+
+		It("should resolve includes of remote documents", func() {
+			Expect(includeURI("s3://us-west-2/bucket/conf/app.yaml", "../shared/db.yaml")).Should(Equal("s3://us-west-2/bucket/shared/db.yaml"))
+			Expect(includeURI("https://example.com/conf/app.yaml?v=1", "db.yaml")).Should(Equal("https://example.com/conf/db.yaml"))
+			Expect(includeURI("conf/app.yaml", "/etc/db.yaml")).Should(Equal("/etc/db.yaml"))
+			Expect(includeURI("conf/app.yaml", "https://example.com/db.yaml")).Should(Equal("https://example.com/db.yaml"))
+		})
+
+	})
+
+	Describe("yaml streams", func() {
+
+		Context("loading every document of a stream", func() {
+			Reset()
+			source := "test/config/stream.yaml"
+			data, _ := ioutil.ReadFile(source)
+			err := loadYAML(source, data)
+			server := GetAny("server")
+			client := GetAny("client")
+			timeoutPos, _ := PositionOf("server:timeout")
+			hostPos, _ := PositionOf("server:host")
+			prodPos, _ := PositionOf("environment:prod:server:host")
+			previousEnv, previousComp := environment, component
+			environment = "prod"
+			prodHost := Get("server:host")
+			prodPort := GetInt("server:port")
+			component = "api"
+			apiPort := GetInt("server:port")
+			environment, component = "staging", ""
+			stagingHost := Get("server:host")
+			environment, component = previousEnv, previousComp
+			Reset()
+			badErr := loadYAML("bad.yaml", []byte("a: 1\n---\nwhen: prod\nb: 2\n"))
+			badA := GetAny("a")
+			Reset()
+
+			It("should merge documents in order", func() {
+				Expect(err).Should(BeNil())
+				Expect(server).Should(Equal(map[interface{}]interface{}{
+					"host":    "localhost",
+					"port":    9090,
+					"timeout": "10s",
+				}))
+				Expect(timeoutPos.String()).Should(Equal("test/config/stream.yaml:17:3"))
+				Expect(hostPos.String()).Should(Equal("test/config/stream.yaml:2:3"))
+			})
+
+			It("should apply anchors and merge keys", func() {
+				Expect(client).Should(Equal(map[interface{}]interface{}{"tls": true, "debug": true}))
+			})
+
+			It("should load documents with a header into their environment", func() {
+				Expect(prodPos.String()).Should(Equal("test/config/stream.yaml:22:3"))
+				Expect(prodHost).Should(Equal("prod.example.com"))
+				Expect(prodPort).Should(Equal(9090))
+				Expect(apiPort).Should(Equal(443))
+				Expect(stagingHost).Should(Equal("staging.example.com"))
+			})
+
+			It("should reject invalid headers", func() {
+				Expect(badErr).ShouldNot(BeNil())
+				Expect(badErr.Error()).Should(Equal("bad.yaml:3:7: when must be a mapping of environment and component"))
+				Expect(badA).Should(BeNil())
+			})
+		})
+
+		Context("loading a single document", func() {
+			Reset()
+			envErr := loadYAML("env.yaml", []byte("environment: prod\nport: 1\n"))
+			port := GetAny("port")
+			env := GetAny("environment")
+			Reset()
+			whenErr := loadYAML("when.yaml", []byte("when:\n  ready: true\nport: 2\n"))
+			when := GetAny("when:ready")
+			Reset()
+
+			It("should not read headers", func() {
+				Expect(envErr).Should(BeNil())
+				Expect(port).Should(Equal(1))
+				Expect(env).Should(Equal("prod"))
+				Expect(whenErr).Should(BeNil())
+				Expect(when).Should(BeTrue())
+			})
+		})
+
+		Context("including a stream", func() {
+			Reset()
+			source := "test/config/stream-include.yaml"
+			data, _ := ioutil.ReadFile(source)
+			err := loadYAML(source, data)
+			server := GetAny("server")
+			prodPos, _ := PositionOf("environment:prod:server:host")
+			previous := environment
+			environment = "prod"
+			prodHost := Get("server:host")
+			environment = previous
+			Reset()
+
+			It("should merge its documents", func() {
+				Expect(err).Should(BeNil())
+				Expect(server).Should(Equal(map[interface{}]interface{}{"host": "localhost", "port": 9090}))
+			})
+
+			It("should load documents with a header into their environment", func() {
+				Expect(prodHost).Should(Equal("prod.example.com"))
+				Expect(prodPos.String()).Should(Equal("test/config/stream-server.yaml:8:1"))
+			})
+		})
+
+	})
 })
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+var (
+	// AgeKeyFile is the file holding the age identities that decrypt whole
+	// config documents named *.age, e.g. config/app.yaml.age. When empty,
+	// CONFIG_AGE_KEY_FILE is used. Identities can also be given directly
+	// in CONFIG_AGE_KEY
+	AgeKeyFile = ""
+
+	// DataKeyFile is the file holding the base64 encoded AES-256 key that
+	// decrypts ENC[...] values. When empty, CONFIG_DATA_KEY_FILE is used.
+	// The key can also be given directly in CONFIG_DATA_KEY
+	DataKeyFile = ""
+)
+
+// encryptedValuePattern matches values encrypted with EncryptValue, e.g.
+// ENC[AES256_GCM,data:...,iv:...,tag:...,type:str]
+var encryptedValuePattern = regexp.MustCompile(
+	`^ENC\[AES256_GCM,data:([A-Za-z0-9+/=]*),iv:([A-Za-z0-9+/=]+),tag:([A-Za-z0-9+/=]+),type:(str|int|float|bool)\]$`,
+)
+
+// ageIdentities returns the identities from CONFIG_AGE_KEY and the age
+// key file
+func ageIdentities() ([]age.Identity, error) {
+
+	var identities []age.Identity
+
+	if key := os.Getenv("CONFIG_AGE_KEY"); key != "" {
+		parsed, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("CONFIG_AGE_KEY: %v", err)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	keyFile := AgeKeyFile
+	if keyFile == "" {
+		keyFile = os.Getenv("CONFIG_AGE_KEY_FILE")
+	}
+	if keyFile != "" {
+		f, err := os.Open(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		parsed, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no age identity, set CONFIG_AGE_KEY or CONFIG_AGE_KEY_FILE")
+	}
+	return identities, nil
+}
+
+// decryptDocument decrypts a config document named *.age with the age
+// identities. Other documents are returned as they are. Documents may be
+// binary or ASCII armored
+func decryptDocument(source string, data []byte) ([]byte, error) {
+
+	if !strings.HasSuffix(strings.ToLower(source), ".age") {
+		return data, nil
+	}
+
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not decrypt: %v", source, err)
+	}
+
+	var in io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header)) {
+		in = armor.NewReader(bytes.NewReader(bytes.TrimSpace(data)))
+	}
+	out, err := age.Decrypt(in, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not decrypt: %v", source, err)
+	}
+	plain, err := ioutil.ReadAll(out)
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not decrypt: %v", source, err)
+	}
+	return plain, nil
+}
+
+// dataKey returns the AES-256 key for ENC[...] values
+func dataKey() ([]byte, error) {
+
+	encoded := os.Getenv("CONFIG_DATA_KEY")
+
+	keyFile := DataKeyFile
+	if keyFile == "" {
+		keyFile = os.Getenv("CONFIG_DATA_KEY_FILE")
+	}
+	if encoded == "" && keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+
+	if encoded == "" {
+		return nil, fmt.Errorf("no data key, set CONFIG_DATA_KEY or CONFIG_DATA_KEY_FILE")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid data key: expected 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// EncryptValue encrypts a string, int, float or bool with a 32 byte key
+// into an ENC[...] value. Config documents holding such values are
+// decrypted on load with the key from CONFIG_DATA_KEY or the data key file.
+// The value only decrypts at keyPath, e.g. db:password, so that it cannot be
+// moved to another key
+func EncryptValue(keyPath string, value interface{}, key []byte) (string, error) {
+
+	var plain, valueType string
+	switch v := value.(type) {
+	case string:
+		plain, valueType = v, "str"
+	case int:
+		plain, valueType = strconv.Itoa(v), "int"
+	case float64:
+		plain, valueType = strconv.FormatFloat(v, 'g', -1, 64), "float"
+	case bool:
+		plain, valueType = strconv.FormatBool(v), "bool"
+	default:
+		return "", fmt.Errorf("cannot encrypt %T values", value)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nil, iv, []byte(plain), []byte(normalizeKey(keyPath)))
+	data, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return fmt.Sprintf(
+		"ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(data),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(tag),
+		valueType,
+	), nil
+}
+
+// isEncryptedValue reports whether a value looks like an ENC[...] value
+func isEncryptedValue(s string) bool {
+	return strings.HasPrefix(s, "ENC[") && strings.HasSuffix(s, "]")
+}
+
+// decryptValue decrypts an ENC[...] value of keyPath to its original type
+func decryptValue(keyPath, s string, key []byte) (interface{}, error) {
+
+	match := encryptedValuePattern.FindStringSubmatch(s)
+	if match == nil {
+		return nil, fmt.Errorf("malformed encrypted value")
+	}
+	var parts [3][]byte
+	for i := range parts {
+		decoded, err := base64.StdEncoding.DecodeString(match[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed encrypted value: %v", err)
+		}
+		parts[i] = decoded
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed encrypted value: invalid iv")
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(normalizeKey(keyPath)))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt value: %v", err)
+	}
+
+	switch match[4] {
+	case "int":
+		return strconv.Atoi(string(plain))
+	case "float":
+		return strconv.ParseFloat(string(plain), 64)
+	case "bool":
+		return strconv.ParseBool(string(plain))
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
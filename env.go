@@ -2,38 +2,280 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+var (
+	// EnvPrefixes are the prefixes of env variables that set config keys,
+	// e.g. []string{"MYAPP", "CONFIG"}. Earlier prefixes take precedence.
+	// When empty, ConfigPrefix is used
+	EnvPrefixes []string
+
+	// EnvSeparator separates the nodes of a key in env variable names, e.g.
+	// CONFIG_SERVER__PORT sets server:port
+	EnvSeparator = "__"
+
+	// FileEnvSuffix marks env variables holding the path of a file to read
+	// the value of a sensitive key from, e.g.
+	// CONFIG_DB__PASSWORD_FILE=/run/secrets/db sets db:password. Keys opt in
+	// by being sensitive, see IsSensitive. An empty suffix turns this off
+	FileEnvSuffix = "_FILE"
+
+	// SecretFileMaxSize is the largest file read for a _FILE variable
+	SecretFileMaxSize int64 = 64 << 10
+
+	// SecretFileMaxPerm are the permissions a file read for a _FILE variable
+	// may have at most. By default the file may not be writable by group or
+	// others
+	SecretFileMaxPerm os.FileMode = 0755
+
+	// CoerceEnv types env values as YAML scalars, e.g. CONFIG_PORT=8080
+	// sets the int 8080 and CONFIG_DEBUG=true the bool true
+	CoerceEnv = false
+
+	envBindings      = make(map[string]string)
+	envBindingsMutex = &sync.Mutex{}
 )
 
+// BindEnv makes an env variable without a prefix set a config key, e.g.
+// BindEnv("DATABASE_URL", "db:url")
+func BindEnv(name, key string) {
+	envBindingsMutex.Lock()
+	envBindings[name] = normalizeKey(key)
+	envBindingsMutex.Unlock()
+}
+
+// boundEnvKeys returns the keys set by bound env variables
+func boundEnvKeys() []string {
+	envBindingsMutex.Lock()
+	defer envBindingsMutex.Unlock()
+	var keys []string
+	for _, key := range envBindings {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// resetEnvBindings forgets all env variables bound with BindEnv
+func resetEnvBindings() {
+	envBindingsMutex.Lock()
+	envBindings = make(map[string]string)
+	envBindingsMutex.Unlock()
+}
+
+// envPrefixes returns the env variable prefixes in order of precedence
+func envPrefixes() []string {
+	if len(EnvPrefixes) == 0 {
+		return []string{ConfigPrefix}
+	}
+	return EnvPrefixes
+}
+
+// envKey makes a config key out of a prefixed env variable, e.g.
+// CONFIG_SERVER__PORT becomes server:port. The second return value is the
+// precedence of the prefix, lower is stronger, or -1 without a prefix
+func envKey(name string) (string, int) {
+	for i, prefix := range envPrefixes() {
+		if stripped, ok := stripPrefix(name, prefix); ok {
+			return strings.Replace(stripped, strings.ToLower(EnvSeparator), ":", -1), i
+		}
+	}
+	return "", -1
+}
+
+// fileEnvName strips FileEnvSuffix from an env variable name. The second
+// return value reports whether the name has the suffix. A suffix that is
+// part of a separator, like in CONFIG_LOG__FILE, does not count
+func fileEnvName(name string) (string, bool) {
+	suffix := strings.ToUpper(FileEnvSuffix)
+	upper := strings.ToUpper(name)
+	if suffix == "" || len(name) <= len(suffix) || !strings.HasSuffix(upper, suffix) {
+		return name, false
+	}
+	stripped := name[:len(name)-len(suffix)]
+	if sep := strings.ToUpper(EnvSeparator); sep != "" {
+		if i := strings.LastIndex(upper, sep); i >= 0 && i+len(sep) > len(stripped) {
+			return name, false
+		}
+	}
+	return stripped, true
+}
+
+// envVarKey returns the key set by a prefixed env variable, and its
+// precedence, or -1 without a prefix. The third return value reports
+// whether the variable holds the path of a file to read a sensitive key from
+func envVarKey(name string) (string, int, bool) {
+	if stripped, ok := fileEnvName(name); ok {
+		if key, precedence := envKey(stripped); precedence >= 0 && IsSensitive(key) {
+			return key, precedence, true
+		}
+	}
+	key, precedence := envKey(name)
+	return key, precedence, false
+}
+
+// readSecretFile reads the value of a _FILE variable, within the size and
+// permission limits, without its trailing newline
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&^SecretFileMaxPerm != 0 {
+		return "", fmt.Errorf("%s has permissions %v, at most %v allowed", path, perm, SecretFileMaxPerm)
+	}
+	if info.Size() > SecretFileMaxSize {
+		return "", fmt.Errorf("%s is larger than %d bytes", path, SecretFileMaxSize)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, SecretFileMaxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > SecretFileMaxSize {
+		return "", fmt.Errorf("%s is larger than %d bytes", path, SecretFileMaxSize)
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r"), nil
+}
+
+// envVar is a prefixed env variable with the key it sets
+type envVar struct {
+	name, key, val string
+	precedence     int
+	// file is set for _FILE variables, whose value is a file path
+	file bool
+}
+
 func loadEnvironmentVariables() {
 
-	// walk env variables
+	// env variables bound to declared options, e.g. PORT
+	loadOptionEnvNames()
+
+	// env variables bound with BindEnv
+	envBindingsMutex.Lock()
+	bindings := make(map[string]string, len(envBindings))
+	for name, key := range envBindings {
+		bindings[name] = key
+	}
+	envBindingsMutex.Unlock()
+	var names []string
+	for name := range bindings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if val, ok := os.LookupEnv(name); ok {
+			Set(bindings[name], val)
+			setPosition(bindings[name], Position{Source: "env " + name})
+		}
+	}
+
+	// walk env variables with a prefix
+	var vars []envVar
 	for _, pair := range os.Environ() {
 		parts := strings.SplitN(pair, "=", 2)
-		key := parts[0]
-		val := parts[1]
+		if reservedEnvVars[parts[0]] {
+			continue
+		}
+		if key, precedence, file := envVarKey(parts[0]); precedence >= 0 {
+			vars = append(vars, envVar{name: parts[0], key: key, val: parts[1], precedence: precedence, file: file})
+		}
+	}
 
-		// if starts with CONFIG
-		if strippedKey, ok := stripConfigPrefix(key); ok {
+	// set weaker prefixes first, so that stronger ones override them, and
+	// files before values set directly
+	sort.SliceStable(vars, func(i, j int) bool {
+		if vars[i].precedence != vars[j].precedence {
+			return vars[i].precedence > vars[j].precedence
+		}
+		return vars[i].file && !vars[j].file
+	})
 
-			// if the variable is json, set as JSON
-			if isJSON(val) {
-				SetJSON(strippedKey, val)
-				continue
+	for _, v := range vars {
+		key := v.key
+		var err error
+		switch {
+		case v.file:
+			// secret mounted as a file, e.g. CONFIG_DB__PASSWORD_FILE
+			var secret string
+			if secret, err = readSecretFile(v.val); err == nil {
+				Set(key, escapeExpressions(secret))
+				MarkSensitive(key)
 			}
-
+		case strings.HasSuffix(key, ":json"):
+			// forced JSON, e.g. CONFIG_SERVERS__JSON
+			key = strings.TrimSuffix(key, ":json")
+			err = SetJSON(key, v.val)
+		case strings.HasSuffix(key, ":yaml"):
+			// forced YAML, e.g. CONFIG_SERVERS__YAML
+			key = strings.TrimSuffix(key, ":yaml")
+			err = SetYAML(key, v.val)
+		case isJSON(v.val):
+			// if the variable is json, set as JSON
+			err = SetJSON(key, v.val)
+		case CoerceEnv:
+			Set(key, envValue(v.val))
+		default:
 			// if the variable is a simple string, just use it
-			Set(strippedKey, val)
+			Set(key, v.val)
 		}
+		if err != nil {
+			addWarning(fmt.Errorf("env %s: %v", v.name, err))
+			continue
+		}
+		setPosition(normalizeKey(key), Position{Source: "env " + v.name})
+	}
+}
+
+// envValue types an env value as a YAML scalar: true and false become
+// bools, and numbers become ints and floats. Numbers with leading zeros,
+// like 0755, and everything else stay strings
+func envValue(val string) interface{} {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal([]byte(val), &doc); err != nil || len(doc.Content) != 1 {
+		return val
+	}
+	scalar := doc.Content[0]
+	if scalar.Kind != yamlv3.ScalarNode || scalar.Style != 0 {
+		return val
+	}
+	switch scalar.Tag {
+	case "!!int":
+		digits := strings.TrimLeft(val, "+-")
+		if len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+			return val
+		}
+	case "!!float", "!!bool":
+	default:
+		return val
+	}
+	var typed interface{}
+	if err := scalar.Decode(&typed); err != nil {
+		return val
 	}
+	return typed
 }
 
 func isJSON(s string) bool {
 
 	// It might be json if it is bracketed
 	mightBeJSON := false
-	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "{") {
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
 		mightBeJSON = true
 	}
 	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
@@ -0,0 +1,244 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// boundFlag is a flag of a flag set bound with BindFlagSet
+type boundFlag struct {
+	name     string
+	key      string
+	value    interface{}
+	defValue interface{}
+	set      bool
+	isBool   bool
+}
+
+// flagBinding collects the flags of a bound flag set. Flags are read when
+// Load runs, so that they reflect the parsed command line
+type flagBinding func() []boundFlag
+
+var (
+	flagBindings      []flagBinding
+	flagBindingsMutex = &sync.Mutex{}
+)
+
+// BindFlagSet registers the flags of an existing flag set as config keys,
+// named prefix:flag (or just flag with an empty prefix). Parse the flag set
+// before calling Load. Flags set on the command line then override every
+// other config source, while the defaults of unset flags only apply to
+// keys no config source sets
+func BindFlagSet(fs *flag.FlagSet, prefix string) {
+	bindFlags(func() []boundFlag {
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+
+		var flags []boundFlag
+		fs.VisitAll(func(f *flag.Flag) {
+			bf := boundFlag{
+				name:     f.Name,
+				key:      flagKey(prefix, f.Name),
+				value:    flagValue(f.Value),
+				defValue: f.DefValue,
+				set:      set[f.Name],
+			}
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+				bf.isBool = b.IsBoolFlag()
+			}
+			flags = append(flags, bf)
+		})
+		return flags
+	})
+}
+
+// bindFlags registers a flag binding
+func bindFlags(binding flagBinding) {
+	flagBindingsMutex.Lock()
+	flagBindings = append(flagBindings, binding)
+	flagBindingsMutex.Unlock()
+}
+
+// boundFlags returns the flags of all bound flag sets
+func boundFlags() []boundFlag {
+	flagBindingsMutex.Lock()
+	bindings := append([]flagBinding(nil), flagBindings...)
+	flagBindingsMutex.Unlock()
+
+	var flags []boundFlag
+	for _, binding := range bindings {
+		flags = append(flags, binding()...)
+	}
+	return flags
+}
+
+// resetFlagBindings forgets all bound flag sets
+func resetFlagBindings() {
+	flagBindingsMutex.Lock()
+	flagBindings = nil
+	flagBindingsMutex.Unlock()
+}
+
+// flagKey names the config key of a bound flag
+func flagKey(prefix, name string) string {
+	if prefix == "" {
+		return normalizeKey(name)
+	}
+	return normalizeKey(prefix + ":" + name)
+}
+
+// flagValue returns the typed value of a flag when available
+func flagValue(value flag.Value) interface{} {
+	getter, ok := value.(flag.Getter)
+	if !ok {
+		return value.String()
+	}
+	switch v := getter.Get().(type) {
+	case time.Duration:
+		return v.String()
+	case uint:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint64:
+		return int(v)
+	default:
+		return v
+	}
+}
+
+// loadFlagSets applies bound flag sets: flags set on the command line
+// override the config, and defaults fill in unset keys
+func loadFlagSets() {
+	for _, f := range boundFlags() {
+		if f.set {
+			Set(f.key, f.value)
+			setPosition(f.key, Position{Source: "flag --" + f.name})
+			continue
+		}
+		if getT(f.key) == nil && f.defValue != "" {
+			Set(f.key, f.value)
+			setPosition(f.key, Position{Source: "default of flag --" + f.name})
+		}
+	}
+}
+
+// withoutBoundFlags removes the flags of bound flag sets, with their
+// values, from command line args. The flag sets parse those themselves
+func withoutBoundFlags(args []string) []string {
+	flags := boundFlags()
+	if len(flags) == 0 {
+		return args
+	}
+	byName := make(map[string]boundFlag)
+	for _, f := range flags {
+		byName[f.name] = f
+	}
+
+	var remaining []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(remaining, args[i:]...)
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			remaining = append(remaining, arg)
+			continue
+		}
+		hasValue := strings.Contains(name, "=")
+		name = strings.SplitN(name, "=", 2)[0]
+		f, ok := byName[name]
+		if !ok {
+			remaining = append(remaining, arg)
+			continue
+		}
+		// skip the separate value of non-bool flags
+		if !hasValue && !f.isBool {
+			i++
+		}
+	}
+	return remaining
+}
+
+// configFlag is a flag.Value reading and writing a config key
+type configFlag struct {
+	key    string
+	isBool bool
+}
+
+func (f *configFlag) String() string {
+	if f == nil || f.key == "" {
+		return ""
+	}
+	return Get(f.key)
+}
+
+func (f *configFlag) Set(value string) error {
+	Set(f.key, value)
+	setPosition(f.key, Position{Source: "flag --" + f.key})
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func (f *configFlag) Get() interface{} {
+	return GetAny(f.key)
+}
+
+// NewFlagSet generates a flag set with a flag for every key of the config
+// tree and every declared option, e.g. -server:port. Their defaults are the
+// current config values, and setting them sets the config key
+func NewFlagSet(name string, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, errorHandling)
+
+	usage := make(map[string]string)
+	for _, option := range Options() {
+		usage[option.Key] = option.Description
+	}
+
+	keys := make(map[string]bool)
+	collectLeafKeys(resolved(), "", keys)
+	for key := range usage {
+		keys[key] = true
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		_, isBool := GetAny(key).(bool)
+		if option, ok := lookupOption(key); ok {
+			_, isBool = option.Default.(bool)
+		}
+		desc := usage[key]
+		if desc == "" {
+			desc = fmt.Sprintf("sets %s", key)
+		}
+		fs.Var(&configFlag{key: key, isBool: isBool}, key, desc)
+	}
+	return fs
+}
+
+// collectLeafKeys adds the path of every leaf of a config tree to keys
+func collectLeafKeys(node map[interface{}]interface{}, path string, keys map[string]bool) {
+	for k, val := range node {
+		keyPath := joinKeyPath(path, k)
+		if child, ok := val.(map[interface{}]interface{}); ok {
+			collectLeafKeys(child, keyPath, keys)
+			continue
+		}
+		keys[keyPath] = true
+	}
+}
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// funcs returns the functions available in {{ }} actions of config values.
+// They compute values without side effects:
+//
+//	upper, lower         change the case of a string
+//	default DEF VAL      VAL, or DEF if VAL is empty, e.g. {{ env "X" | default "y" }}
+//	join SEP LIST        join the items of a list
+//	base64, sha256       encode a string, sha256 as hex
+//	hostname             the host name
+//	file PATH            the contents of a file, without the trailing newline
+//	env NAME             an env variable
+//	key NAME             the expanded value of a key
+//	now                  the current time
+//	duration S           parse a duration such as 1m30s
+//	add, sub, mul, div   arithmetic on numbers and durations
+//
+// Files are read within the limits of _FILE variables. Values from remote
+// sources cannot use env and file
+func (e *expander) funcs(key string) template.FuncMap {
+	return template.FuncMap{
+		"upper":   strings.ToUpper,
+		"lower":   strings.ToLower,
+		"default": defaultFunc,
+		"join":    joinFunc,
+		"base64": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"sha256": func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		},
+		"hostname": os.Hostname,
+		"file": func(path string) (string, error) {
+			if err := localOnly(key, "files"); err != nil {
+				return "", err
+			}
+			return readSecretFile(path)
+		},
+		"env": func(name string) (string, error) {
+			if err := localOnly(key, "env variables"); err != nil {
+				return "", err
+			}
+			return os.Getenv(name), nil
+		},
+		"key": func(ref string) (interface{}, error) {
+			val, err := e.lookupKey(ref)
+			if err == nil && val == nil {
+				err = fmt.Errorf("%s is not set", ref)
+			}
+			return val, err
+		},
+		"now":      time.Now,
+		"duration": time.ParseDuration,
+		"add": func(a, b interface{}) (interface{}, error) {
+			return arithmetic("add", a, b)
+		},
+		"sub": func(a, b interface{}) (interface{}, error) {
+			return arithmetic("sub", a, b)
+		},
+		"mul": func(a, b interface{}) (interface{}, error) {
+			return arithmetic("mul", a, b)
+		},
+		"div": func(a, b interface{}) (interface{}, error) {
+			return arithmetic("div", a, b)
+		},
+	}
+}
+
+// render executes the {{ }} actions of a value of key
+func (e *expander) render(key, s string) (string, error) {
+	tmpl, err := template.New(key).Funcs(e.funcs(key)).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", &TemplateError{Key: key, Message: err.Error()}
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, nil); err != nil {
+		// keep reference cycles as they are
+		if templateErr, ok := unwrapTemplateError(err); ok {
+			return "", templateErr
+		}
+		return "", &TemplateError{Key: key, Message: err.Error()}
+	}
+	return out.String(), nil
+}
+
+// unwrapTemplateError finds a TemplateError returned by a function, e.g.
+// a reference cycle found by key
+func unwrapTemplateError(err error) (*TemplateError, bool) {
+	for err != nil {
+		if templateErr, ok := err.(*TemplateError); ok {
+			return templateErr, true
+		}
+		unwrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil, false
+		}
+		err = unwrapper.Unwrap()
+	}
+	return nil, false
+}
+
+// escapeActions keeps text interpolated into a value with {{ }} actions
+// from being executed
+func escapeActions(s string) string {
+	return strings.Replace(s, "{{", `{{"{{"}}`, -1)
+}
+
+func defaultFunc(def interface{}, vals ...interface{}) interface{} {
+	if len(vals) == 0 {
+		return def
+	}
+	val := vals[len(vals)-1]
+	if val == nil || fmt.Sprint(val) == "" {
+		return def
+	}
+	return val
+}
+
+func joinFunc(sep string, list interface{}) (string, error) {
+	var items []string
+	switch list := list.(type) {
+	case []string:
+		items = list
+	case []interface{}:
+		for _, item := range list {
+			items = append(items, fmt.Sprint(item))
+		}
+	default:
+		return "", fmt.Errorf("join: %T is not a list", list)
+	}
+	return strings.Join(items, sep), nil
+}
+
+// number converts a function argument to an int, a float64 or a
+// time.Duration. Strings are parsed, e.g. "30s" becomes a duration
+func number(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case int, float64, time.Duration:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case string:
+		if n, err := strconv.Atoi(v); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f, nil
+		}
+		if d, err := time.ParseDuration(v); err == nil {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("%v is not a number or duration", v)
+}
+
+// arithmetic adds, subtracts, multiplies or divides numbers and durations.
+// Durations can be added to and subtracted from durations, and multiplied
+// or divided by numbers. Dividing two durations gives their ratio
+func arithmetic(op string, a, b interface{}) (interface{}, error) {
+
+	x, err := number(a)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	y, err := number(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+
+	xd, xIsDuration := x.(time.Duration)
+	yd, yIsDuration := y.(time.Duration)
+
+	switch {
+	case xIsDuration && yIsDuration:
+		switch op {
+		case "add":
+			return xd + yd, nil
+		case "sub":
+			return xd - yd, nil
+		case "div":
+			if yd == 0 {
+				return nil, fmt.Errorf("div: division by zero")
+			}
+			return float64(xd) / float64(yd), nil
+		}
+		return nil, fmt.Errorf("%s: cannot multiply durations", op)
+
+	case xIsDuration || yIsDuration:
+		d, n := xd, y
+		if yIsDuration {
+			d, n = yd, x
+		}
+		factor := toFloat(n)
+		switch {
+		case op == "mul":
+			return time.Duration(float64(d) * factor), nil
+		case op == "div" && xIsDuration:
+			if factor == 0 {
+				return nil, fmt.Errorf("div: division by zero")
+			}
+			return time.Duration(float64(d) / factor), nil
+		}
+		return nil, fmt.Errorf("%s: cannot %s a number and a duration", op, op)
+	}
+
+	xi, xIsInt := x.(int)
+	yi, yIsInt := y.(int)
+	if xIsInt && yIsInt {
+		switch op {
+		case "add":
+			return xi + yi, nil
+		case "sub":
+			return xi - yi, nil
+		case "mul":
+			return xi * yi, nil
+		}
+		if yi == 0 {
+			return nil, fmt.Errorf("div: division by zero")
+		}
+		return xi / yi, nil
+	}
+
+	xf, yf := toFloat(x), toFloat(y)
+	switch op {
+	case "add":
+		return xf + yf, nil
+	case "sub":
+		return xf - yf, nil
+	case "mul":
+		return xf * yf, nil
+	}
+	if yf == 0 {
+		return nil, fmt.Errorf("div: division by zero")
+	}
+	return xf / yf, nil
+}
+
+func toFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
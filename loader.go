@@ -1,10 +1,16 @@
 package config
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -16,17 +22,170 @@ type Loader interface {
 	Load() ([]byte, error)
 }
 
+// ContextLoader is a Loader that honors cancellation and deadlines of
+// the provided context
+type ContextLoader interface {
+	LoadContext(ctx context.Context) ([]byte, error)
+}
+
+// AsContextLoader adapts a Loader to a ContextLoader. Loaders that already
+// implement ContextLoader are returned as-is. Plain loaders are run in the
+// background, and abandoned if the context is done before they return
+func AsContextLoader(l Loader) ContextLoader {
+	if cl, ok := l.(ContextLoader); ok {
+		return cl
+	}
+	return loaderAdapter{l}
+}
+
+type loaderAdapter struct {
+	loader Loader
+}
+
+type loadResult struct {
+	data []byte
+	err  error
+}
+
+func (a loaderAdapter) LoadContext(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan loadResult, 1)
+	go func() {
+		data, err := a.loader.Load()
+		done <- loadResult{data, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-done:
+		return res.data, res.err
+	}
+}
+
+// withTimeout derives a context bounded by timeout. A zero timeout leaves
+// the context as it is
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// splitURIParams separates the query parameters from a config URI, e.g.
+// s3://us-west-2/bucket/key?timeout=5s returns s3://us-west-2/bucket/key
+// and timeout=5s
+func splitURIParams(uri string) (string, url.Values, error) {
+	parts := strings.SplitN(uri, "?", 2)
+	if len(parts) == 1 {
+		return uri, url.Values{}, nil
+	}
+	params, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid parameters in config uri %q: %v", uri, err)
+	}
+	return parts[0], params, nil
+}
+
+// timeoutParam reads the `timeout` parameter of a config URI
+func timeoutParam(params url.Values) (time.Duration, error) {
+	raw := params.Get("timeout")
+	if raw == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %v", raw, err)
+	}
+	return timeout, nil
+}
+
+// withoutTimeout removes the `timeout` parameter from a config URI, which
+// changes how a source is fetched but not what it is
+func withoutTimeout(uri string) string {
+	base, params, err := splitURIParams(uri)
+	if err != nil {
+		return uri
+	}
+	params.Del("timeout")
+	if len(params) > 0 {
+		base += "?" + params.Encode()
+	}
+	return base
+}
+
+// loaderForURI returns the loader responsible for the given config URI.
+// Remote sources are verified against their signature once trusted keys
+// are configured
+func loaderForURI(uri string) (ContextLoader, error) {
+	loader, err := sourceLoader(uri)
+	if err != nil {
+		return nil, err
+	}
+	if LoaderType(uri) == "file" {
+		return loader, nil
+	}
+
+	keys, err := trustedKeys()
+	if err != nil || len(keys) == 0 {
+		return loader, err
+	}
+	sigURI := signatureURI(uri)
+	sigLoader, err := sourceLoader(sigURI)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingLoader{
+		uri:       uri,
+		sigURI:    sigURI,
+		loader:    loader,
+		sigLoader: sigLoader,
+		keys:      keys,
+	}, nil
+}
+
+// sourceLoader returns the loader reading the given config URI
+func sourceLoader(uri string) (ContextLoader, error) {
+	switch LoaderType(uri) {
+	case "s3":
+		s3Config, err := S3ConfigFromURI(uri)
+		if err != nil {
+			return nil, err
+		}
+		return NewS3Loader(*s3Config)
+	case "http":
+		httpConfig, err := HTTPConfigFromURI(uri)
+		if err != nil {
+			return nil, err
+		}
+		return NewHTTPLoader(*httpConfig)
+	default:
+		fileConfig, err := FileConfigFromURI(uri)
+		if err != nil {
+			return nil, err
+		}
+		return NewFileLoader(*fileConfig)
+	}
+}
+
 const s3URIPrefix = "s3://"
 
 func LoaderType(uri string) string {
 	if strings.HasPrefix(uri, s3URIPrefix) {
 		return "s3"
 	}
+	if strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+		return "http"
+	}
 	return "file"
 }
 
 type FileConfig struct {
-	Path string
+	Path    string
+	Timeout time.Duration
 }
 type FileLoader struct {
 	config FileConfig
@@ -39,15 +198,48 @@ func NewFileLoader(rawConfig interface{}) (*FileLoader, error) {
 	return nil, errors.New("config must be of type `FileConfig`")
 }
 
+// FileConfigFromURI parses a file path, with optional parameters, into
+// a FileConfig. E.g. config/app.yaml?timeout=2s
+func FileConfigFromURI(uri string) (*FileConfig, error) {
+	path, params, err := splitURIParams(uri)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := timeoutParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return &FileConfig{Path: path, Timeout: timeout}, nil
+}
+
 // Load grabs configuration from a file
 func (l *FileLoader) Load() ([]byte, error) {
+	return l.LoadContext(context.Background())
+}
+
+// LoadContext grabs configuration from a file, giving up when the context
+// is done or the configured timeout elapses
+func (l *FileLoader) LoadContext(ctx context.Context) ([]byte, error) {
 
 	if !pathExists(l.config.Path) {
 		return nil, errors.New("invalid file path")
 	}
 
-	return ioutil.ReadFile(l.config.Path)
+	ctx, cancel := withTimeout(ctx, l.config.Timeout)
+	defer cancel()
 
+	read := loaderFunc(func() ([]byte, error) {
+		return ioutil.ReadFile(l.config.Path)
+	})
+	return AsContextLoader(read).LoadContext(ctx)
+
+}
+
+// loaderFunc lets an ordinary function act as a Loader
+type loaderFunc func() ([]byte, error)
+
+func (f loaderFunc) Load() ([]byte, error) {
+	return f()
 }
 
 // pathExists checks if an os file path exists
@@ -60,31 +252,48 @@ func pathExists(path string) bool {
 }
 
 // S3ConfigFromURI parses a URI string into an S3Config
-// s3://BUCKET/OBJECT
+// s3://REGION/BUCKET/OBJECT, optionally followed by parameters,
+// e.g. s3://us-west-2/bucket/app.yaml?timeout=5s
 func S3ConfigFromURI(uri string) (*S3Config, error) {
-	if uri[0:5] != s3URIPrefix {
+	if !strings.HasPrefix(uri, s3URIPrefix) {
 		return nil, errors.New("uri not of format s3://<region>/<bucket>/<key>")
 	}
+	uri, params, err := splitURIParams(uri)
+	if err != nil {
+		return nil, err
+	}
 	uri = strings.TrimPrefix(uri, s3URIPrefix)
 
-	uriParts := strings.SplitN(uri, "/", 2)
+	uriParts := strings.SplitN(uri, "/", 3)
 	if len(uriParts) < 3 {
 		return nil, errors.New("uri not of format s3://<region>/<bucket>/<key>")
 	}
+
+	timeout, err := timeoutParam(params)
+	if err != nil {
+		return nil, err
+	}
+
 	return &S3Config{
-		Region: uriParts[0],
-		Bucket: uriParts[1],
-		Key:    uriParts[2],
+		Region:  uriParts[0],
+		Bucket:  uriParts[1],
+		Key:     uriParts[2],
+		Timeout: timeout,
 	}, nil
 }
 
 type S3Config struct {
-	Region string
-	Bucket string
-	Key    string
+	Region  string
+	Bucket  string
+	Key     string
+	Timeout time.Duration
 }
 type S3Loader struct {
 	config S3Config
+	// client is created once, on first use, and shared by concurrent loads
+	clientOnce sync.Once
+	client     *s3.S3
+	clientErr  error
 }
 
 func NewS3Loader(rawConfig interface{}) (*S3Loader, error) {
@@ -97,11 +306,33 @@ func NewS3Loader(rawConfig interface{}) (*S3Loader, error) {
 // Load grabs configuration from s3. This will use whatever credentials
 // you have in your environment
 func (l *S3Loader) Load() ([]byte, error) {
+	return l.LoadContext(context.Background())
+}
+
+// LoadContext grabs configuration from s3, giving up when the context is
+// done or the configured timeout elapses. The s3 client is created once
+// per loader and reused on subsequent calls
+func (l *S3Loader) LoadContext(ctx context.Context) ([]byte, error) {
 
-	client := s3.New(session.New(), &aws.Config{Region: aws.String(l.config.Region)})
+	l.clientOnce.Do(func() {
+		sess, err := session.NewSession(&aws.Config{Region: aws.String(l.config.Region)})
+		if err != nil {
+			l.clientErr = err
+			return
+		}
+		l.client = s3.New(sess)
+	})
+	if l.clientErr != nil {
+		return nil, l.clientErr
+	}
+	client := l.client
+
+	ctx, cancel := withTimeout(ctx, l.config.Timeout)
+	defer cancel()
 
 	// ensure the desired s3 bucket exists and is accessible
-	_, err := client.GetBucketVersioning(
+	_, err := client.GetBucketVersioningWithContext(
+		ctx,
 		&s3.GetBucketVersioningInput{
 			Bucket: aws.String(l.config.Bucket),
 		},
@@ -110,7 +341,8 @@ func (l *S3Loader) Load() ([]byte, error) {
 		return nil, err
 	}
 
-	resp, err := client.GetObject(
+	resp, err := client.GetObjectWithContext(
+		ctx,
 		&s3.GetObjectInput{
 			Bucket: aws.String(l.config.Bucket),
 			Key:    aws.String(l.config.Key),
@@ -124,6 +356,7 @@ func (l *S3Loader) Load() ([]byte, error) {
 		}
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	conf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -133,3 +366,72 @@ func (l *S3Loader) Load() ([]byte, error) {
 	return conf, nil
 
 }
+
+// HTTPConfigFromURI parses an http or https URL into an HTTPConfig. The
+// timeout parameter is taken out of the URL, other parameters are kept,
+// e.g. https://config.example.com/app.yaml?timeout=5s
+func HTTPConfigFromURI(uri string) (*HTTPConfig, error) {
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("uri not of format http(s)://<host>/<path>")
+	}
+
+	params := u.Query()
+	timeout, err := timeoutParam(params)
+	if err != nil {
+		return nil, err
+	}
+	params.Del("timeout")
+	u.RawQuery = params.Encode()
+
+	return &HTTPConfig{URL: u.String(), Timeout: timeout}, nil
+}
+
+type HTTPConfig struct {
+	URL     string
+	Timeout time.Duration
+}
+type HTTPLoader struct {
+	config HTTPConfig
+	client *http.Client
+}
+
+func NewHTTPLoader(rawConfig interface{}) (*HTTPLoader, error) {
+	if config, ok := rawConfig.(HTTPConfig); ok {
+		return &HTTPLoader{config: config, client: http.DefaultClient}, nil
+	}
+	return nil, errors.New("config must be of type `HTTPConfig`")
+}
+
+// Load grabs configuration from an http(s) URL
+func (l *HTTPLoader) Load() ([]byte, error) {
+	return l.LoadContext(context.Background())
+}
+
+// LoadContext grabs configuration from an http(s) URL, giving up when the
+// context is done or the configured timeout elapses
+func (l *HTTPLoader) LoadContext(ctx context.Context) ([]byte, error) {
+
+	ctx, cancel := withTimeout(ctx, l.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, l.config.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := l.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errors.New("http config not found")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("http config request failed: %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+
+}
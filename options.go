@@ -0,0 +1,425 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Option declares a config key that the application expects, with its
+// default value and documentation
+type Option struct {
+	Key         string
+	Default     interface{}
+	Description string
+	// EnvNames are additional env variables setting the key, e.g. PORT
+	EnvNames []string
+	// Aliases are additional long flag names setting the key
+	Aliases []string
+	// Enum lists the allowed values, if restricted
+	Enum []string
+	// Short is the single letter flag setting the key, if any
+	Short rune
+	// Count makes repeated short flags count, e.g. -vvv sets 3
+	Count bool
+}
+
+// OptionSetting customizes an option passed to Define
+type OptionSetting func(*Option)
+
+// EnvName binds env variables, besides the CONFIG_ prefixed one, to an
+// option. E.g. EnvName("PORT")
+func EnvName(names ...string) OptionSetting {
+	return func(o *Option) {
+		o.EnvNames = append(o.EnvNames, names...)
+	}
+}
+
+// Alias adds flag names for an option. E.g. Alias("listen") lets
+// --listen=8080 set server:port
+func Alias(names ...string) OptionSetting {
+	return func(o *Option) {
+		for _, name := range names {
+			o.Aliases = append(o.Aliases, strings.ToLower(name))
+		}
+	}
+}
+
+// Enum restricts an option to a set of values. They are also offered by
+// shell completion
+func Enum(values ...string) OptionSetting {
+	return func(o *Option) {
+		o.Enum = append(o.Enum, values...)
+	}
+}
+
+// Short adds a single letter flag for an option, e.g. Short('p') lets
+// -p 8080 set server:port
+func Short(short rune) OptionSetting {
+	return func(o *Option) {
+		o.Short = short
+	}
+}
+
+// Count makes an option count its short flag, e.g. -vvv sets 3. Use it
+// with Short
+func Count() OptionSetting {
+	return func(o *Option) {
+		o.Count = true
+	}
+}
+
+var (
+	options      = make(map[string]*Option)
+	optionsMutex = &sync.Mutex{}
+)
+
+// ErrHelp is returned by Load when --help, -h or --completion=<shell> was
+// passed and options are defined. The usage text or completion script has
+// been written to HelpOutput by then
+var ErrHelp = errors.New("config: help requested")
+
+// HelpOutput receives the usage text printed for --help, and the
+// completion script printed for --completion
+var HelpOutput io.Writer = os.Stdout
+
+// builtinFlags are handled by Load itself
+var builtinFlags = map[string]bool{
+	"help":       true,
+	"h":          true,
+	"completion": true,
+}
+
+// Define declares a config key. Load sets the default if no config source
+// sets the key, and checks that values coming from files, env variables
+// and flags have the type of the default. Supported types are string,
+// int, float64, bool, time.Duration and []string. E.g.
+// config.Define("server:port", 8080, "HTTP listen port", config.EnvName("PORT"))
+func Define(key string, def interface{}, description string, settings ...OptionSetting) {
+	option := &Option{
+		Key:         normalizeKey(key),
+		Default:     def,
+		Description: description,
+	}
+	for _, setting := range settings {
+		setting(option)
+	}
+
+	optionsMutex.Lock()
+	options[option.Key] = option
+	optionsMutex.Unlock()
+
+	if option.Short != 0 {
+		setShortFlag(option.Short, shortFlag{key: option.Key, count: option.Count})
+	}
+}
+
+// Options returns the declared options, sorted by key
+func Options() []Option {
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+
+	list := make([]Option, 0, len(options))
+	for _, option := range options {
+		list = append(list, *option)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// resetOptions forgets all declared options
+func resetOptions() {
+	optionsMutex.Lock()
+	options = make(map[string]*Option)
+	optionsMutex.Unlock()
+}
+
+// lookupOption returns the option declared for a key
+func lookupOption(key string) (Option, bool) {
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+	option, ok := options[normalizeKey(key)]
+	if !ok {
+		return Option{}, false
+	}
+	return *option, true
+}
+
+// optionForFlag returns the key set by a flag name, resolving aliases
+// and short flags
+func optionForFlag(name string) string {
+	if short, ok := lookupShortFlag(name); ok {
+		return short.key
+	}
+	for _, option := range Options() {
+		for _, alias := range option.Aliases {
+			if alias == name {
+				return option.Key
+			}
+		}
+	}
+	return name
+}
+
+// envVarName returns the env variable for a key, with the strongest of
+// EnvPrefixes, e.g. CONFIG_SERVER__PORT
+func envVarName(key string) string {
+	prefix := strings.TrimRight(envPrefixes()[0], "_:")
+	return fmt.Sprintf("%s_%s", prefix, strings.ToUpper(strings.Replace(key, ":", EnvSeparator, -1)))
+}
+
+// loadOptionEnvNames sets options from the env variables bound to them
+func loadOptionEnvNames() {
+	for _, option := range Options() {
+		for _, name := range option.EnvNames {
+			if val, ok := os.LookupEnv(name); ok {
+				Set(option.Key, val)
+				setPosition(option.Key, Position{Source: "env " + name})
+			}
+		}
+	}
+}
+
+// helpRequested reports whether --help or -h was passed, once options
+// are defined
+func helpRequested() bool {
+	if len(Options()) == 0 {
+		return false
+	}
+	for _, pair := range parseCommandLineArgs() {
+		if pair.Key == "help" || pair.Key == "h" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOptions sets the defaults of declared options that no config source
+// set, and converts the other values to the type of their default. Values of
+// the environment and component overlays are converted as well
+func applyOptions() error {
+	var errs Errors
+	for _, option := range Options() {
+
+		if getT(option.Key) == nil && option.Default != nil {
+			Set(option.Key, defaultValue(option.Default))
+			setPosition(option.Key, Position{Source: "default"})
+		}
+
+		for _, layer := range overlayKeys(option.Key) {
+			if err := applyOptionLayer(option, layer); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// applyOptionLayer converts the value set at layer, one of the overlay keys
+// of the option, to the type of the option's default
+func applyOptionLayer(option Option, layer string) error {
+	val := getT(layer)
+	if val == nil {
+		return nil
+	}
+	layerOption := option
+	layerOption.Key = layer
+	converted, err := convertOption(layerOption, val)
+	if err == nil {
+		err = checkEnum(layerOption, converted)
+	}
+	if err != nil {
+		return err
+	}
+	pos, hasPos := PositionOf(layer)
+	Set(layer, converted)
+	if hasPos {
+		setPosition(layer, pos)
+	}
+	return nil
+}
+
+// defaultValue returns an option default as stored in the config tree
+func defaultValue(def interface{}) interface{} {
+	switch def := def.(type) {
+	case time.Duration:
+		return def.String()
+	case []string:
+		list := make([]interface{}, len(def))
+		for i, item := range def {
+			list[i] = item
+		}
+		return list
+	}
+	return def
+}
+
+// convertOption converts a value to the type of the option's default.
+// Strings, as set by env variables and flags, are parsed
+func convertOption(option Option, val interface{}) (interface{}, error) {
+
+	invalid := func() error {
+		source := "set at runtime"
+		if pos, ok := PositionOf(option.Key); ok {
+			source = pos.String()
+		}
+		return fmt.Errorf("%s: invalid value %v for %s: expected %s", source, redact(val, option.Key), option.Key, typeName(option.Default))
+	}
+
+	s, isString := val.(string)
+
+	switch option.Default.(type) {
+
+	case nil:
+		return val, nil
+
+	case string:
+		if isString {
+			return s, nil
+		}
+		switch val.(type) {
+		case int, int64, uint64, float64, bool:
+			return fmt.Sprint(val), nil
+		}
+
+	case int:
+		switch n := val.(type) {
+		case int:
+			return n, nil
+		case string:
+			if i, err := strconv.Atoi(strings.TrimSpace(n)); err == nil {
+				return i, nil
+			}
+		}
+
+	case float64:
+		switch n := val.(type) {
+		case float64:
+			return n, nil
+		case int:
+			return float64(n), nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(n), 64); err == nil {
+				return f, nil
+			}
+		}
+
+	case bool:
+		switch b := val.(type) {
+		case bool:
+			return b, nil
+		case string:
+			if parsed, err := strconv.ParseBool(strings.TrimSpace(b)); err == nil {
+				return parsed, nil
+			}
+		}
+
+	case time.Duration:
+		if isString {
+			if _, err := time.ParseDuration(strings.TrimSpace(s)); err == nil {
+				return strings.TrimSpace(s), nil
+			}
+		}
+
+	case []string:
+		switch list := val.(type) {
+		case []interface{}:
+			return list, nil
+		case string:
+			var items []interface{}
+			for _, item := range strings.Split(list, ",") {
+				items = append(items, strings.TrimSpace(item))
+			}
+			return items, nil
+		}
+
+	default:
+		return val, nil
+	}
+
+	return nil, invalid()
+}
+
+// checkEnum makes sure a value is one of the option's allowed values
+func checkEnum(option Option, val interface{}) error {
+	if len(option.Enum) == 0 {
+		return nil
+	}
+	for _, allowed := range option.Enum {
+		if fmt.Sprint(val) == allowed {
+			return nil
+		}
+	}
+	source := "set at runtime"
+	if pos, ok := PositionOf(option.Key); ok {
+		source = pos.String()
+	}
+	return fmt.Errorf("%s: invalid value %v for %s: expected one of %s", source, redact(val, option.Key), option.Key, strings.Join(option.Enum, ", "))
+}
+
+// typeName describes the type of an option default in usage text
+func typeName(def interface{}) string {
+	switch def.(type) {
+	case string:
+		return "string"
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case bool:
+		return "bool"
+	case time.Duration:
+		return "duration"
+	case []string:
+		return "list"
+	}
+	return "value"
+}
+
+// Usage returns the help text describing every declared option, the flag
+// setting it and its env variables
+func Usage() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Usage: %s [options]\n\nOptions:\n", filepath.Base(os.Args[0]))
+
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	for _, option := range Options() {
+
+		flags := []string{fmt.Sprintf("--%s=<%s>", option.Key, typeName(option.Default))}
+		if option.Short != 0 {
+			flags = append([]string{fmt.Sprintf("-%c", option.Short)}, flags...)
+		}
+		for _, alias := range option.Aliases {
+			flags = append(flags, "--"+alias)
+		}
+
+		var details []string
+		if len(option.Enum) > 0 {
+			details = append(details, "one of "+strings.Join(option.Enum, ", "))
+		}
+		if option.Default != nil {
+			details = append(details, fmt.Sprintf("default %v", redact(option.Default, option.Key)))
+		}
+		envNames := append([]string{envVarName(option.Key)}, option.EnvNames...)
+		details = append(details, "env "+strings.Join(envNames, ", "))
+
+		fmt.Fprintf(w, "  %s\t%s (%s)\n", strings.Join(flags, ", "), option.Description, strings.Join(details, "; "))
+	}
+	w.Flush()
+
+	return buf.String()
+}
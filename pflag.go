@@ -0,0 +1,58 @@
+package config
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// BindPFlagSet registers the flags of a pflag flag set as config keys,
+// like BindFlagSet does for the standard library's flag sets
+func BindPFlagSet(fs *pflag.FlagSet, prefix string) {
+	bindFlags(func() []boundFlag {
+		var flags []boundFlag
+		fs.VisitAll(func(f *pflag.Flag) {
+			flags = append(flags, boundFlag{
+				name:     f.Name,
+				key:      flagKey(prefix, f.Name),
+				value:    pflagValue(f),
+				defValue: f.DefValue,
+				set:      f.Changed,
+				isBool:   f.NoOptDefVal != "",
+			})
+			if f.Shorthand != "" {
+				flags = append(flags, boundFlag{
+					name:   f.Shorthand,
+					key:    flagKey(prefix, f.Name),
+					isBool: f.NoOptDefVal != "",
+				})
+			}
+		})
+		return flags
+	})
+}
+
+// pflagValue converts a pflag value to the type it declares
+func pflagValue(f *pflag.Flag) interface{} {
+	s := f.Value.String()
+	switch f.Value.Type() {
+	case "bool":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64":
+		if n, err := strconv.Atoi(s); err == nil {
+			return n
+		}
+	case "float32", "float64":
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n
+		}
+	case "duration":
+		if d, err := time.ParseDuration(s); err == nil {
+			return d.String()
+		}
+	}
+	return s
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Position locates where a config key was defined, e.g. a line within a
+// config file, or an environment variable
+type Position struct {
+	Source string
+	Line   int
+	Column int
+}
+
+// String formats the position as source:line:column
+func (p Position) String() string {
+	if p.Line == 0 {
+		return p.Source
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Source, p.Line, p.Column)
+}
+
+var (
+	positions      = make(map[string]Position)
+	positionsMutex = &sync.Mutex{}
+)
+
+// PositionOf returns where a key was defined. The key is not resolved
+// against the environment or component, so e.g.
+// PositionOf("environment:prod:server:port") must be used for the
+// production override of server:port
+func PositionOf(key string) (Position, bool) {
+	positionsMutex.Lock()
+	defer positionsMutex.Unlock()
+	pos, ok := positions[strings.ToLower(key)]
+	return pos, ok
+}
+
+// setPosition records where a key was defined
+func setPosition(key string, pos Position) {
+	positionsMutex.Lock()
+	positions[key] = pos
+	positionsMutex.Unlock()
+}
+
+// clearPositions forgets the positions of a key and everything below it
+func clearPositions(key string) {
+	positionsMutex.Lock()
+	defer positionsMutex.Unlock()
+	for k := range positions {
+		if k == key || strings.HasPrefix(k, key+":") {
+			delete(positions, k)
+		}
+	}
+}
+
+// resetPositions forgets all recorded positions
+func resetPositions() {
+	positionsMutex.Lock()
+	positions = make(map[string]Position)
+	positionsMutex.Unlock()
+}
+
+// Explain describes the effective value of a key and where it was
+// defined, e.g. "server:port = 8080 (config/base.yaml:42:3)". Values
+// coming from an environment or component override name the overriding
+// key
+func Explain(key string) string {
+	key = strings.ToLower(key)
+
+	val := GetAny(key)
+	if val == nil {
+		return fmt.Sprintf("%s is not set", key)
+	}
+
+	source := "set at runtime"
+	layer, pos, ok := definedAt(key)
+	if ok {
+		source = pos.String()
+	}
+	if layer != key {
+		source = fmt.Sprintf("%s via %s", source, layer)
+	}
+	return fmt.Sprintf("%s = %v (%s)", key, redact(val, key), source)
+}
+
+// definedAt finds the most specific layer (see overlayKeys) defining a key,
+// and where that layer was defined. The layer is returned even if its
+// position is unknown
+func definedAt(key string) (string, Position, bool) {
+	key = strings.ToLower(key)
+	layers := overlayKeys(key)
+	for i := len(layers) - 1; i >= 0; i-- {
+		if getT(layers[i]) == nil {
+			continue
+		}
+		pos, ok := PositionOf(layers[i])
+		return layers[i], pos, ok
+	}
+	return key, Position{}, false
+}
@@ -0,0 +1,393 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// SchemaError describes a config value that does not satisfy the schema
+type SchemaError struct {
+	Key      string
+	Message  string
+	Position *Position
+}
+
+func (e *SchemaError) Error() string {
+	if e.Position != nil {
+		return fmt.Sprintf("%s: %s: %s", e.Position, e.Key, e.Message)
+	}
+	if e.Key == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Key, e.Message)
+}
+
+// declaredSchema is the last schema validated against. Shell completion
+// offers its keys and enums
+var (
+	declaredSchema      map[string]interface{}
+	declaredSchemaMutex = &sync.Mutex{}
+)
+
+// setDeclaredSchema records the schema for shell completion
+func setDeclaredSchema(schema map[string]interface{}) {
+	declaredSchemaMutex.Lock()
+	declaredSchema = schema
+	declaredSchemaMutex.Unlock()
+}
+
+// getDeclaredSchema returns the last schema validated against, if any
+func getDeclaredSchema() map[string]interface{} {
+	declaredSchemaMutex.Lock()
+	defer declaredSchemaMutex.Unlock()
+	return declaredSchema
+}
+
+// ValidateSchema checks the config, as resolved for the current environment
+// and component, against a JSON Schema. The schema may be written in JSON
+// or YAML. The supported keywords are type, enum, const, required,
+// properties, additionalProperties, items, minItems, maxItems, minimum,
+// maximum, exclusiveMinimum, exclusiveMaximum, minLength, maxLength and
+// pattern. Values set from strings (e.g. env variables) satisfy integer,
+// number and boolean types if they parse as such. All problems are
+// returned together as Errors
+func ValidateSchema(schema []byte) error {
+
+	rootSchema, err := parseSchema(schema)
+	if err != nil {
+		return err
+	}
+	setDeclaredSchema(rootSchema)
+
+	v := &schemaValidator{}
+	v.validate(rootSchema, resolved(), "")
+	if len(v.errs) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		return v.errs[i].(*SchemaError).Key < v.errs[j].(*SchemaError).Key
+	})
+	return v.errs
+}
+
+// parseSchema decodes a JSON or YAML schema
+func parseSchema(schema []byte) (map[string]interface{}, error) {
+	var root interface{}
+	if err := yamlv3.Unmarshal(schema, &root); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	rootSchema, ok := root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid schema: must be an object")
+	}
+	return rootSchema, nil
+}
+
+// fetchSchema fetches a schema from a config source
+func fetchSchema(ctx context.Context, uri string) ([]byte, error) {
+	loader, err := loaderForURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := fetch(ctx, uri, loader)
+	if err != nil {
+		return nil, fmt.Errorf("could not load schema %s: %v", uri, err)
+	}
+	return schema, nil
+}
+
+// validateSchemaURI fetches a schema from a config source and validates
+// the config against it
+func validateSchemaURI(ctx context.Context, uri string) error {
+	schema, err := fetchSchema(ctx, uri)
+	if err != nil {
+		return err
+	}
+	return ValidateSchema(schema)
+}
+
+// declareSchemaURI records a schema for shell completion without
+// validating the config against it
+func declareSchemaURI(ctx context.Context, uri string) error {
+	schema, err := fetchSchema(ctx, uri)
+	if err != nil {
+		return err
+	}
+	rootSchema, err := parseSchema(schema)
+	if err != nil {
+		return err
+	}
+	setDeclaredSchema(rootSchema)
+	return nil
+}
+
+type schemaValidator struct {
+	errs Errors
+}
+
+func (v *schemaValidator) fail(key, format string, args ...interface{}) {
+	err := &SchemaError{Key: key, Message: fmt.Sprintf(format, args...)}
+	if _, pos, ok := definedAt(key); ok {
+		err.Position = &pos
+	}
+	v.errs = append(v.errs, err)
+}
+
+func (v *schemaValidator) validate(schema map[string]interface{}, val interface{}, key string) {
+
+	if types, ok := schemaTypes(schema); ok && !v.checkType(types, val, key) {
+		// further checks make little sense on a value of the wrong type
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if sameValue(allowed, val) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(key, "must be one of %s", formatEnum(enum))
+		}
+	}
+
+	if constVal, ok := schema["const"]; ok && !sameValue(constVal, val) {
+		v.fail(key, "must be %v", constVal)
+	}
+
+	if n, ok := toNumber(val); ok {
+		v.checkRange(schema, n, key)
+	}
+
+	if s, ok := val.(string); ok {
+		v.checkString(schema, s, key)
+	}
+
+	switch val := val.(type) {
+	case map[interface{}]interface{}:
+		v.checkObject(schema, val, key)
+	case []interface{}:
+		v.checkArray(schema, val, key)
+	}
+}
+
+func (v *schemaValidator) checkType(types []string, val interface{}, key string) bool {
+	for _, t := range types {
+		if hasType(t, val) {
+			return true
+		}
+	}
+	v.fail(key, "must be of type %s", strings.Join(types, " or "))
+	return false
+}
+
+func (v *schemaValidator) checkRange(schema map[string]interface{}, n float64, key string) {
+	if min, ok := toNumber(schema["minimum"]); ok && n < min {
+		v.fail(key, "must be at least %v", schema["minimum"])
+	}
+	if max, ok := toNumber(schema["maximum"]); ok && n > max {
+		v.fail(key, "must be at most %v", schema["maximum"])
+	}
+	if min, ok := toNumber(schema["exclusiveMinimum"]); ok && n <= min {
+		v.fail(key, "must be greater than %v", schema["exclusiveMinimum"])
+	}
+	if max, ok := toNumber(schema["exclusiveMaximum"]); ok && n >= max {
+		v.fail(key, "must be less than %v", schema["exclusiveMaximum"])
+	}
+}
+
+func (v *schemaValidator) checkString(schema map[string]interface{}, s string, key string) {
+	length := float64(len([]rune(s)))
+	if min, ok := toNumber(schema["minLength"]); ok && length < min {
+		v.fail(key, "must be at least %v characters long", schema["minLength"])
+	}
+	if max, ok := toNumber(schema["maxLength"]); ok && length > max {
+		v.fail(key, "must be at most %v characters long", schema["maxLength"])
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			v.fail(key, "schema has invalid pattern %q: %v", pattern, err)
+		} else if !re.MatchString(s) {
+			v.fail(key, "must match %q", pattern)
+		}
+	}
+}
+
+func (v *schemaValidator) checkObject(schema map[string]interface{}, obj map[interface{}]interface{}, key string) {
+
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if _, ok := lookupKey(obj, fmt.Sprint(name)); !ok {
+				v.fail(joinKeyPath(key, name), "is required")
+			}
+		}
+	}
+
+	for k, val := range obj {
+		name := fmt.Sprint(k)
+		childKey := joinKeyPath(key, name)
+
+		if propSchema, ok := lookupProperty(properties, name); ok {
+			v.validate(propSchema, val, childKey)
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(childKey, "is not a known key%s", suggestKey(name, properties))
+			}
+		case map[string]interface{}:
+			v.validate(additional, val, childKey)
+		}
+	}
+}
+
+func (v *schemaValidator) checkArray(schema map[string]interface{}, list []interface{}, key string) {
+	count := float64(len(list))
+	if min, ok := toNumber(schema["minItems"]); ok && count < min {
+		v.fail(key, "must have at least %v items", schema["minItems"])
+	}
+	if max, ok := toNumber(schema["maxItems"]); ok && count > max {
+		v.fail(key, "must have at most %v items", schema["maxItems"])
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, item := range list {
+			v.validate(items, item, fmt.Sprintf("%s[%d]", key, i))
+		}
+	}
+}
+
+// schemaTypes returns the types allowed by a schema
+func schemaTypes(schema map[string]interface{}) ([]string, bool) {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}, true
+	case []interface{}:
+		var types []string
+		for _, item := range t {
+			types = append(types, fmt.Sprint(item))
+		}
+		return types, true
+	}
+	return nil, false
+}
+
+// hasType reports whether a value satisfies a JSON Schema type
+func hasType(t string, val interface{}) bool {
+	switch t {
+	case "object":
+		_, ok := val.(map[interface{}]interface{})
+		return ok
+	case "array":
+		_, ok := val.([]interface{})
+		return ok
+	case "string":
+		_, ok := val.(string)
+		return ok
+	case "null":
+		return val == nil
+	case "boolean":
+		switch val := val.(type) {
+		case bool:
+			return true
+		case string:
+			_, err := strconv.ParseBool(val)
+			return err == nil
+		}
+		return false
+	case "integer":
+		n, ok := toNumber(val)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := toNumber(val)
+		return ok
+	}
+	return false
+}
+
+// toNumber converts numeric values, and strings that hold a number
+func toNumber(val interface{}) (float64, bool) {
+	switch n := val.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// sameValue compares a schema value with a config value. Numbers compare
+// by value and strings compare to their formatted equivalent, since env
+// variables and flags are always strings
+func sameValue(schemaVal, val interface{}) bool {
+	if a, ok := toNumber(schemaVal); ok {
+		if _, isString := schemaVal.(string); !isString {
+			b, ok := toNumber(val)
+			return ok && a == b
+		}
+	}
+	return fmt.Sprint(schemaVal) == fmt.Sprint(val)
+}
+
+func formatEnum(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, val := range enum {
+		values[i] = fmt.Sprintf("%v", val)
+	}
+	return strings.Join(values, ", ")
+}
+
+// lookupKey finds a key in a config map, case-insensitively
+func lookupKey(obj map[interface{}]interface{}, name string) (interface{}, bool) {
+	for k, val := range obj {
+		if strings.EqualFold(fmt.Sprint(k), name) {
+			return val, true
+		}
+	}
+	return nil, false
+}
+
+// lookupProperty finds a property schema, case-insensitively
+func lookupProperty(properties map[string]interface{}, name string) (map[string]interface{}, bool) {
+	for k, propSchema := range properties {
+		if strings.EqualFold(k, name) {
+			schema, ok := propSchema.(map[string]interface{})
+			return schema, ok
+		}
+	}
+	return nil, false
+}
+
+// suggestKey proposes the property closest to an unknown key
+func suggestKey(name string, properties map[string]interface{}) string {
+	var names []string
+	for k := range properties {
+		names = append(names, k)
+	}
+	if best := closest(name, names); best != "" {
+		return fmt.Sprintf(", did you mean %q?", best)
+	}
+	return ""
+}
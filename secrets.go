@@ -0,0 +1,222 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-yaml/yaml"
+)
+
+// SecretProvider resolves secret references. A value of
+// secret://vault/kv/db#password, or a ${secret:vault:kv/db#password}
+// reference inside a value, is resolved at Load time by the provider
+// registered as vault, with the path kv/db. The optional field picks a
+// field of a secret holding a JSON or YAML object
+type SecretProvider interface {
+	Secret(ctx context.Context, path string) (string, error)
+}
+
+// SecretCacheTTL is how long resolved secrets are kept, so that reloading
+// config doesn't fetch every secret again. Zero turns caching off
+var SecretCacheTTL = 5 * time.Minute
+
+// SecretError describes a secret reference that could not be resolved
+type SecretError struct {
+	Key      string
+	Ref      string
+	Position *Position
+	Err      error
+}
+
+func (e *SecretError) Error() string {
+	if e.Position != nil {
+		return fmt.Sprintf("%s: %s: secret %s: %v", e.Position, e.Key, e.Ref, e.Err)
+	}
+	return fmt.Sprintf("%s: secret %s: %v", e.Key, e.Ref, e.Err)
+}
+
+func (e *SecretError) Unwrap() error {
+	return e.Err
+}
+
+const secretScheme = "secret://"
+
+// secretRefPattern matches ${secret:provider:path#field} references
+var secretRefPattern = regexp.MustCompile(`\$\{secret:([^:}]+):([^}]+)\}`)
+
+var (
+	secretProviders      = make(map[string]SecretProvider)
+	secretProvidersMutex = &sync.Mutex{}
+)
+
+// cachedSecret is a resolved secret and the time it expires
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+var (
+	secretCache      = make(map[string]cachedSecret)
+	secretCacheMutex = &sync.Mutex{}
+)
+
+// RegisterSecretProvider makes a provider resolve the secret references
+// naming it
+func RegisterSecretProvider(name string, provider SecretProvider) {
+	secretProvidersMutex.Lock()
+	secretProviders[name] = provider
+	secretProvidersMutex.Unlock()
+}
+
+// resetSecretProviders forgets all registered providers and cached secrets
+func resetSecretProviders() {
+	secretProvidersMutex.Lock()
+	secretProviders = make(map[string]SecretProvider)
+	secretProvidersMutex.Unlock()
+	secretCacheMutex.Lock()
+	secretCache = make(map[string]cachedSecret)
+	secretCacheMutex.Unlock()
+}
+
+// FileSecretProvider reads secrets from the files in a directory, e.g. the
+// path db/password is read from Dir/db/password. Files are read within the
+// limits of _FILE variables, without their trailing newline
+type FileSecretProvider struct {
+	Dir string
+}
+
+func (p FileSecretProvider) Secret(ctx context.Context, path string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	// clean against the root, so that the path cannot leave Dir
+	return readSecretFile(filepath.Join(p.Dir, filepath.Clean("/"+path)))
+}
+
+// resolveSecret returns a secret from the cache or from its provider
+func resolveSecret(ctx context.Context, provider, path, field string) (string, error) {
+
+	cacheKey := provider + ":" + path
+	secretCacheMutex.Lock()
+	cached, ok := secretCache[cacheKey]
+	secretCacheMutex.Unlock()
+
+	value := cached.value
+	if !ok || time.Now().After(cached.expires) {
+		secretProvidersMutex.Lock()
+		p, ok := secretProviders[provider]
+		secretProvidersMutex.Unlock()
+		if !ok {
+			return "", fmt.Errorf("unknown secret provider %q", provider)
+		}
+
+		var err error
+		if value, err = p.Secret(ctx, path); err != nil {
+			return "", err
+		}
+		if SecretCacheTTL > 0 {
+			secretCacheMutex.Lock()
+			secretCache[cacheKey] = cachedSecret{value: value, expires: time.Now().Add(SecretCacheTTL)}
+			secretCacheMutex.Unlock()
+		}
+	}
+
+	if field == "" {
+		return value, nil
+	}
+	var fields map[string]interface{}
+	if err := yaml.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("secret is not an object: %v", err)
+	}
+	fieldValue, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("secret has no field %q", field)
+	}
+	return fmt.Sprint(fieldValue), nil
+}
+
+// splitSecretPath splits the field off a secret path, e.g. kv/db#password
+func splitSecretPath(path string) (string, string) {
+	if i := strings.LastIndex(path, "#"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// resolveSecretString resolves the secret references in a value. Secrets
+// are escaped, so that they are not expanded when read. The second return
+// value reports whether the value had any
+func resolveSecretString(ctx context.Context, s string) (string, bool, error) {
+
+	if strings.HasPrefix(s, secretScheme) {
+		parts := strings.SplitN(strings.TrimPrefix(s, secretScheme), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return "", true, fmt.Errorf("expected %sprovider/path", secretScheme)
+		}
+		path, field := splitSecretPath(parts[1])
+		value, err := resolveSecret(ctx, parts[0], path, field)
+		return escapeExpressions(value), true, err
+	}
+
+	if !secretRefPattern.MatchString(s) {
+		return s, false, nil
+	}
+	var err error
+	resolved := secretRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		match := secretRefPattern.FindStringSubmatch(ref)
+		path, field := splitSecretPath(match[2])
+		value, refErr := resolveSecret(ctx, match[1], path, field)
+		if refErr != nil && err == nil {
+			err = refErr
+		}
+		return escapeExpressions(value)
+	})
+	return resolved, true, err
+}
+
+// resolveSecrets replaces the secret references in the config tree with
+// their secrets, and marks the keys holding them as sensitive
+func resolveSecrets(ctx context.Context) error {
+	var errs Errors
+	configMutex.Lock()
+	resolveSecretsIn(ctx, config, "", &errs)
+	configMutex.Unlock()
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func resolveSecretsIn(ctx context.Context, node interface{}, path string, errs *Errors) interface{} {
+	switch val := node.(type) {
+	case string:
+		resolved, isRef, err := resolveSecretString(ctx, val)
+		if !isRef {
+			return val
+		}
+		if err != nil {
+			secretErr := &SecretError{Key: path, Ref: val, Err: err}
+			if pos, ok := PositionOf(path); ok {
+				secretErr.Position = &pos
+			}
+			*errs = append(*errs, secretErr)
+			return val
+		}
+		MarkSensitive(path)
+		return resolved
+	case map[interface{}]interface{}:
+		for k, child := range val {
+			val[k] = resolveSecretsIn(ctx, child, joinKeyPath(path, k), errs)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = resolveSecretsIn(ctx, item, path, errs)
+		}
+	}
+	return node
+}
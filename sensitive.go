@@ -0,0 +1,78 @@
+package config
+
+import (
+	"path"
+	"strings"
+	"sync"
+)
+
+// SensitivePatterns mark keys as sensitive by name. A key is sensitive if
+// one of its nodes matches a pattern, e.g. db:password or tokens:github.
+// Patterns use path.Match syntax and are matched ignoring case
+var SensitivePatterns = []string{"*password*", "*secret*", "*token*"}
+
+var (
+	sensitiveKeys      = make(map[string]bool)
+	sensitiveKeysMutex = &sync.Mutex{}
+)
+
+// MarkSensitive marks a key as holding a secret, e.g. a password. Marking
+// an environment or component override marks the key in every overlay
+func MarkSensitive(key string) {
+	sensitiveKeysMutex.Lock()
+	sensitiveKeys[stripOverlay(normalizeKey(key))] = true
+	sensitiveKeysMutex.Unlock()
+}
+
+// IsSensitive reports whether a key, or one of the keys above it, holds a
+// secret: it was marked with MarkSensitive or a !secret tag, holds a
+// resolved secret reference, or matches one of SensitivePatterns
+func IsSensitive(key string) bool {
+	sensitiveKeysMutex.Lock()
+	defer sensitiveKeysMutex.Unlock()
+	nodes := nodes(stripOverlay(normalizeKey(key)))
+	for i, node := range nodes {
+		if sensitiveKeys[joinKeys(nodes[:i+1]...)] {
+			return true
+		}
+		for _, pattern := range SensitivePatterns {
+			if matched, _ := path.Match(strings.ToLower(pattern), node); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resetSensitive forgets all keys marked as sensitive
+func resetSensitive() {
+	sensitiveKeysMutex.Lock()
+	sensitiveKeys = make(map[string]bool)
+	sensitiveKeysMutex.Unlock()
+}
+
+// RedactedValue replaces the values of sensitive keys in config dumps
+const RedactedValue = "******"
+
+// redact returns a copy of a config value with the values of sensitive
+// keys masked. path is the key of the value
+func redact(node interface{}, keyPath string) interface{} {
+	if keyPath != "" && IsSensitive(keyPath) {
+		return RedactedValue
+	}
+	switch val := node.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(val))
+		for k, child := range val {
+			out[k] = redact(child, joinKeyPath(keyPath, k))
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = redact(item, keyPath)
+		}
+		return out
+	}
+	return node
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+// shortFlag maps a single letter flag to a config key
+type shortFlag struct {
+	key   string
+	count bool
+}
+
+var (
+	shortFlags      = make(map[rune]shortFlag)
+	shortFlagsMutex = &sync.Mutex{}
+)
+
+// ShortFlag makes a single letter flag set a config key, e.g.
+// ShortFlag('p', "server:port") lets -p 8080 set server:port. -c is
+// reserved for --config
+func ShortFlag(short rune, key string) {
+	setShortFlag(short, shortFlag{key: normalizeKey(key)})
+}
+
+// CountFlag makes a single letter flag count how often it is given, e.g.
+// CountFlag('v', "log:verbosity") lets -vvv (or -v -v -v) set
+// log:verbosity to 3
+func CountFlag(short rune, key string) {
+	setShortFlag(short, shortFlag{key: normalizeKey(key), count: true})
+}
+
+func setShortFlag(short rune, flag shortFlag) {
+	shortFlagsMutex.Lock()
+	shortFlags[short] = flag
+	shortFlagsMutex.Unlock()
+}
+
+// lookupShortFlag returns the registered short flag for a flag name
+func lookupShortFlag(name string) (shortFlag, bool) {
+	short, size := utf8.DecodeRuneInString(name)
+	if size == 0 || size != len(name) {
+		return shortFlag{}, false
+	}
+	shortFlagsMutex.Lock()
+	defer shortFlagsMutex.Unlock()
+	flag, ok := shortFlags[short]
+	return flag, ok
+}
+
+// resetShortFlags forgets all registered short flags
+func resetShortFlags() {
+	shortFlagsMutex.Lock()
+	shortFlags = make(map[rune]shortFlag)
+	shortFlagsMutex.Unlock()
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TrustedKeys are the ed25519 public keys that remote config sources (s3
+// and http) must be signed with. Keys can also be listed, base64 encoded
+// and separated by commas or spaces, in CONFIG_TRUSTED_KEYS. Once any key
+// is configured, every remote source needs a detached signature at its URI
+// followed by .sig, e.g. s3://us-west-2/bucket/app.yaml.sig, holding the
+// raw or base64 encoded signature made by SignSource
+var TrustedKeys []ed25519.PublicKey
+
+// SignatureError describes a remote config source that is not signed by a
+// trusted key. Such sources are never replaced by their cached copy
+type SignatureError struct {
+	URI string
+	Err error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("config source %s rejected: %v", e.URI, e.Err)
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+// trustedKeys returns TrustedKeys and the keys in CONFIG_TRUSTED_KEYS
+func trustedKeys() ([]ed25519.PublicKey, error) {
+	keys := append([]ed25519.PublicKey{}, TrustedKeys...)
+	fields := strings.FieldsFunc(os.Getenv("CONFIG_TRUSTED_KEYS"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+	for _, field := range fields {
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("CONFIG_TRUSTED_KEYS: invalid ed25519 public key %q", field)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
+}
+
+// SignSource signs a config document for the URI it is loaded from. The
+// signature covers the URI, without its timeout parameter, so that a
+// document signed for one source, e.g. staging.yaml, is rejected at
+// another, e.g. prod.yaml
+func SignSource(uri string, data []byte, key ed25519.PrivateKey) []byte {
+	return ed25519.Sign(key, signedMessage(uri, data))
+}
+
+// signedMessage is the message signed for a document at a URI: the URI,
+// a newline and the document
+func signedMessage(uri string, data []byte) []byte {
+	message := []byte(withoutTimeout(uri) + "\n")
+	return append(message, data...)
+}
+
+// signatureURI returns the URI of the detached signature of a source, e.g.
+// https://example.com/app.yaml.sig for https://example.com/app.yaml
+func signatureURI(uri string) string {
+	parts := strings.SplitN(uri, "?", 2)
+	if len(parts) == 1 {
+		return uri + ".sig"
+	}
+	return parts[0] + ".sig?" + parts[1]
+}
+
+// verifyingLoader loads a source and its detached signature, and only
+// returns the source if a trusted key signed it
+type verifyingLoader struct {
+	uri       string
+	sigURI    string
+	loader    ContextLoader
+	sigLoader ContextLoader
+	keys      []ed25519.PublicKey
+}
+
+func (l *verifyingLoader) LoadContext(ctx context.Context) ([]byte, error) {
+
+	data, err := l.loader.LoadContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rawSig, err := l.sigLoader.LoadContext(ctx)
+	if err != nil {
+		// a source we can't get a signature for is not trusted, unless the
+		// fetch itself failed, e.g. timed out
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, &SignatureError{URI: l.uri, Err: fmt.Errorf("no signature at %s: %v", l.sigURI, err)}
+	}
+
+	sig, err := decodeSignature(rawSig)
+	if err != nil {
+		return nil, &SignatureError{URI: l.uri, Err: err}
+	}
+	message := signedMessage(l.uri, data)
+	for _, key := range l.keys {
+		if ed25519.Verify(key, message, sig) {
+			return data, nil
+		}
+	}
+	return nil, &SignatureError{URI: l.uri, Err: errors.New("signature does not match any trusted key")}
+}
+
+// decodeSignature accepts raw and base64 encoded signatures
+func decodeSignature(raw []byte) ([]byte, error) {
+	if len(raw) == ed25519.SignatureSize {
+		return raw, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, errors.New("malformed signature")
+	}
+	return sig, nil
+}
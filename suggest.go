@@ -0,0 +1,82 @@
+package config
+
+import (
+	"sort"
+	"strings"
+)
+
+// closest returns the candidate nearest to name, case-insensitively, if it
+// is within a few edits. A name without ":" is also compared to the last
+// node of nested candidates, so that `prot` suggests `server:port`. Ties go
+// to the alphabetically first candidate
+func closest(name string, candidates []string) string {
+	sorted := append([]string(nil), candidates...)
+	sort.Strings(sorted)
+
+	name = strings.ToLower(name)
+	best, bestDistance := "", maxSuggestDistance(name)+1
+	for _, candidate := range sorted {
+		lower := strings.ToLower(candidate)
+		d := editDistance(name, lower)
+		if !strings.Contains(name, ":") {
+			leaf := lower[strings.LastIndex(lower, ":")+1:]
+			if leafDistance := editDistance(name, leaf); leafDistance < d {
+				d = leafDistance
+			}
+		}
+		if d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// maxSuggestDistance is the edit distance still considered a typo. Short
+// names get less slack, so that e.g. `a` doesn't suggest `b`
+func maxSuggestDistance(name string) int {
+	switch n := len(name); {
+	case n <= 1:
+		return 0
+	case n <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance returns the number of insertions, deletions, substitutions
+// and transpositions of adjacent characters turning a into b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
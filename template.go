@@ -0,0 +1,398 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+)
+
+// TemplateActions runs the {{ }} actions of values, e.g.
+// {{ env "USER" | upper }}. It is off by default, so that values holding
+// other templates, like "Hello {{name}}", are kept as they are. Set it
+// before Load
+var TemplateActions = false
+
+var (
+	envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	keyRefPattern  = regexp.MustCompile(`^[A-Za-z0-9_.-]+(:[A-Za-z0-9_.-]+)*$`)
+)
+
+// TemplateError describes a ${...} expression in a config value that could
+// not be expanded
+type TemplateError struct {
+	Key     string
+	Message string
+}
+
+func (e *TemplateError) Error() string {
+	if e.Key == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Key, e.Message)
+}
+
+// Expand expands the expressions in a string the way config values are
+// expanded when read:
+//
+//	${env:HOME}        the env variable HOME, empty if unset
+//	${HOME}            the same
+//	${key:server:port} the value of server:port
+//	${server:port}     the same, for keys with more than one node
+//	${PORT:-8080}      PORT, or 8080 if PORT is unset or empty
+//	$${HOME}           the literal text ${HOME}
+//
+// Text between ${ and } that is none of these, like ${#list[@]} in a shell
+// snippet, is kept as it is.
+//
+// With TemplateActions set, values can also compute text with {{ }}
+// actions, e.g. {{ env "USER" | default "nobody" | upper }}. Actions run
+// after the ${...} expressions; text those expressions insert is never
+// executed
+//
+// Values from remote sources (s3 or http) cannot read env variables.
+//
+// Keys are looked up when the value is read, through the current
+// environment and component, so overriding server:port in
+// environment:prod changes every value referencing it. Referencing a key
+// that is not set, or a key that references itself, is an error
+func Expand(s string) (string, error) {
+	return (&expander{}).expandString("", s)
+}
+
+// expander expands the ${...} expressions in config values
+type expander struct {
+	// refs are the keys being expanded, to catch reference cycles
+	refs []string
+}
+
+// newExpander returns an expander for the value of a key
+func newExpander(key string) *expander {
+	e := &expander{}
+	if key != "" {
+		e.refs = []string{normalizeKey(key)}
+	}
+	return e
+}
+
+// value expands every string in a config value. Maps and lists are copied
+func (e *expander) value(key string, val interface{}) (interface{}, error) {
+	switch val := val.(type) {
+	case string:
+		// a value that only references another key takes its type, e.g.
+		// port: ${defaults:port} stays an int
+		if expr, ok := soleExpression(replaceTemplates(val)); ok && validExpression(expr) {
+			return e.evalValue(key, expr)
+		}
+		return e.expandString(key, val)
+	case []interface{}:
+		out := make([]interface{}, 0, len(val))
+		for _, item := range val {
+			expanded, err := e.value(key, item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, expanded)
+		}
+		return out, nil
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(val))
+		for k, child := range val {
+			expanded, err := e.value(joinKeyPath(key, k), child)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = expanded
+		}
+		return out, nil
+	}
+	return val, nil
+}
+
+// expandString expands the expressions in a string value of key
+func (e *expander) expandString(key, s string) (string, error) {
+
+	s = replaceTemplates(s)
+	hasActions := TemplateActions && strings.Contains(s, "{{")
+	if !strings.Contains(s, "${") && !hasActions {
+		return s, nil
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(s); {
+		switch {
+		case strings.HasPrefix(s[i:], "$${"):
+			// escaped, keep the expression as it is
+			out.WriteString("${")
+			i += len("$${")
+		case strings.HasPrefix(s[i:], "${"):
+			end := closingBrace(s, i+len("${"))
+			if end < 0 {
+				// not an expression, e.g. a lone ${ in a shell snippet
+				out.WriteString(s[i:])
+				i = len(s)
+				continue
+			}
+			expr := s[i+len("${") : end]
+			if !validExpression(expr) {
+				out.WriteString(s[i : end+1])
+				i = end + 1
+				continue
+			}
+			val, err := e.eval(key, expr)
+			if err != nil {
+				return "", err
+			}
+			if hasActions {
+				val = escapeActions(val)
+			}
+			out.WriteString(val)
+			i = end + 1
+		default:
+			out.WriteByte(s[i])
+			i++
+		}
+	}
+	if hasActions {
+		// {{ }} actions run after the ${...} expressions
+		return e.render(key, out.String())
+	}
+	return out.String(), nil
+}
+
+// escapeExpressions keeps a value read from a secret, like a password
+// holding ${, from being expanded when read. With TemplateActions set,
+// its {{ }} actions are escaped as well
+func escapeExpressions(s string) string {
+	s = strings.Replace(s, "${", "$${", -1)
+	if TemplateActions {
+		s = escapeActions(s)
+	}
+	return s
+}
+
+// closingBrace returns the index of the } closing the expression starting
+// at start, allowing nested expressions in defaults, or -1
+func closingBrace(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "${"):
+			depth++
+			i++
+		case s[i] == '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// eval evaluates the expression between ${ and } to a string
+func (e *expander) eval(key, expr string) (string, error) {
+	val, err := e.evalValue(key, expr)
+	if err != nil {
+		return "", err
+	}
+	switch val.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		return "", &TemplateError{Key: key, Message: fmt.Sprintf("${%s} is not a single value", expr)}
+	}
+	return fmt.Sprint(val), nil
+}
+
+// evalValue evaluates the expression between ${ and }. Key references
+// keep the type of the referenced value
+func (e *expander) evalValue(key, expr string) (interface{}, error) {
+
+	name, def, hasDefault := expr, "", false
+	if i := strings.Index(expr, ":-"); i >= 0 {
+		name, def, hasDefault = expr[:i], expr[i+len(":-"):], true
+	}
+	fallback := func() (interface{}, error) {
+		return e.expandString(key, def)
+	}
+
+	switch {
+	case strings.HasPrefix(name, "secret:"):
+		// secret references are resolved by Load
+		return "${" + expr + "}", nil
+
+	case strings.HasPrefix(name, "env:") || !strings.Contains(name, ":"):
+		if err := localOnly(key, "env variables"); err != nil {
+			return nil, err
+		}
+		val := os.Getenv(strings.TrimPrefix(name, "env:"))
+		if val == "" && hasDefault {
+			return fallback()
+		}
+		return val, nil
+	}
+
+	// key references, either ${key:server:port} or just ${server:port}
+	ref := strings.TrimPrefix(name, "key:")
+	val, err := e.lookupKey(ref)
+	if err != nil {
+		return nil, err
+	}
+	if val != nil && (val != "" || !hasDefault) {
+		return val, nil
+	}
+	if hasDefault {
+		return fallback()
+	}
+	return nil, &TemplateError{Key: key, Message: fmt.Sprintf("${%s} references %s, which is not set", expr, ref)}
+}
+
+// validExpression reports whether the text between ${ and } is an env
+// variable, key or secret reference, with an optional default
+func validExpression(expr string) bool {
+	name := expr
+	if i := strings.Index(expr, ":-"); i >= 0 {
+		name = expr[:i]
+	}
+	switch {
+	case strings.HasPrefix(name, "secret:"):
+		return true
+	case strings.HasPrefix(name, "env:"):
+		return envNamePattern.MatchString(strings.TrimPrefix(name, "env:"))
+	case !strings.Contains(name, ":"):
+		return envNamePattern.MatchString(name)
+	}
+	return keyRefPattern.MatchString(strings.TrimPrefix(name, "key:"))
+}
+
+// localOnly fails for values of keys defined by a remote source (s3 or
+// http), which may not read env variables or local files of the host
+func localOnly(key, what string) error {
+	keys := parentKeys(key)
+	for i := len(keys) - 1; i >= 0; i-- {
+		if _, pos, ok := definedAt(keys[i]); ok {
+			if LoaderType(pos.Source) == "file" {
+				return nil
+			}
+			return &TemplateError{Key: key, Message: fmt.Sprintf("values from %s cannot read %s", pos.Source, what)}
+		}
+	}
+	return nil
+}
+
+// soleExpression returns the expression of a value consisting of a single
+// ${...} expression, e.g. ${server:port}
+func soleExpression(s string) (string, bool) {
+	if !strings.HasPrefix(s, "${") || closingBrace(s, len("${")) != len(s)-1 {
+		return "", false
+	}
+	return s[len("${") : len(s)-1], true
+}
+
+// lookupKey returns the expanded value of a referenced key, as seen through
+// the current environment and component, or nil if it is not set
+func (e *expander) lookupKey(ref string) (interface{}, error) {
+
+	ref = normalizeKey(ref)
+	for i, seen := range e.refs {
+		if seen == ref {
+			return nil, cycleError(e.refs[i:])
+		}
+	}
+
+	raw := getEnvironmentedT(ref)
+	if raw == nil {
+		return nil, nil
+	}
+
+	e.refs = append(e.refs, ref)
+	defer func() { e.refs = e.refs[:len(e.refs)-1] }()
+	return e.value(ref, raw)
+}
+
+// cycleError describes a reference cycle. The cycle is listed from its
+// first key in sort order, so that it reads the same whichever key it was
+// found from
+func cycleError(keys []string) error {
+	first := 0
+	for i, key := range keys {
+		if key < keys[first] {
+			first = i
+		}
+	}
+	cycle := append(append([]string{}, keys[first:]...), keys[:first]...)
+	cycle = append(cycle, cycle[0])
+	return &TemplateError{Key: cycle[0], Message: "reference cycle " + strings.Join(cycle, " -> ")}
+}
+
+// replaceTemplates replaces the {Search} placeholders of Templates
+func replaceTemplates(s string) string {
+	for _, template := range Templates {
+		s = strings.Replace(
+			s,
+			fmt.Sprintf("{%s}", template.Search),
+			template.Replace,
+			-1,
+		)
+	}
+	return s
+}
+
+// evalTemplatesAll expands the expressions in the value of a key. Values
+// that cannot be expanded are returned as they are; Load reports them
+func evalTemplatesAll(key string, cfg interface{}) interface{} {
+	expanded, err := newExpander(key).value(normalizeKey(key), cfg)
+	if err != nil {
+		return cfg
+	}
+	return expanded
+}
+
+// checkTemplates expands every value of the resolved config, and returns
+// the expressions that cannot be expanded. Problems reached from several
+// keys, like the keys of a reference cycle, are reported once
+func checkTemplates() error {
+	var errs Errors
+	seen := make(map[string]bool)
+	for _, name := range resolvedKeys() {
+		_, err := newExpander(name).value(name, getEnvironmentedT(name))
+		if err != nil && !seen[err.Error()] {
+			seen[err.Error()] = true
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Unmarshal decodes the expanded value of a key into out, e.g. a struct,
+// using its yaml field tags. An empty key decodes the whole config, as
+// resolved for the current environment and component
+func Unmarshal(key string, out interface{}) error {
+
+	var val interface{}
+	var err error
+	if key == "" {
+		view := make(map[interface{}]interface{})
+		for _, name := range resolvedKeys() {
+			if view[name], err = newExpander(name).value(name, getEnvironmentedT(name)); err != nil {
+				return err
+			}
+		}
+		val = view
+	} else if val, err = newExpander(key).value(normalizeKey(key), getEnvironmentedT(key)); err != nil {
+		return err
+	}
+
+	if val == nil {
+		return nil
+	}
+	data, err := yaml.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, out)
+}
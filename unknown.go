@@ -0,0 +1,183 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// UnknownKeyPolicy decides what Load does with flags and env variables
+// that don't match any known key
+type UnknownKeyPolicy int
+
+const (
+	// WarnUnknownKeys reports unknown keys through Warnings
+	WarnUnknownKeys UnknownKeyPolicy = iota
+	// FailUnknownKeys makes Load return an error
+	FailUnknownKeys
+	// IgnoreUnknownKeys accepts any key
+	IgnoreUnknownKeys
+)
+
+// UnknownKeys is the policy for unknown flags and env variables. Keys are
+// only checked once options are declared with Define. Declared options,
+// their aliases, reserved keys and keys defined by config files are known
+var UnknownKeys = WarnUnknownKeys
+
+// UnknownKeyError describes a flag or env variable not matching any known
+// key
+type UnknownKeyError struct {
+	// Name is the flag or env variable as given, e.g. --prot or CONFIG_PROT
+	Name string
+	Key  string
+	// Suggestion is the closest known flag or env variable, if any
+	Suggestion string
+}
+
+func (e *UnknownKeyError) Error() string {
+	kind := "flag"
+	if !strings.HasPrefix(e.Name, "-") {
+		kind = "env variable"
+	}
+	if e.Suggestion != "" {
+		return fmt.Sprintf("unknown %s %s, did you mean %s?", kind, e.Name, e.Suggestion)
+	}
+	return fmt.Sprintf("unknown %s %s", kind, e.Name)
+}
+
+// knownKeys returns the keys that flags and env variables may set: declared
+// options and their aliases, bound flags and env variables, and every key in the config tree. Keys mapped
+// to true also accept any key below them, e.g. options without a default
+func knownKeys() map[string]bool {
+	known := make(map[string]bool)
+	collectKeys(config, "", known)
+	for _, option := range Options() {
+		_, isMap := option.Default.(map[interface{}]interface{})
+		known[option.Key] = option.Default == nil || isMap
+		for _, alias := range option.Aliases {
+			known[alias] = false
+		}
+	}
+	for _, f := range boundFlags() {
+		known[f.key] = false
+	}
+	for _, key := range boundEnvKeys() {
+		known[key] = false
+	}
+	return known
+}
+
+// collectKeys adds the path of every node in a config tree to keys
+func collectKeys(node map[interface{}]interface{}, path string, keys map[string]bool) {
+	for k, val := range node {
+		keyPath := joinKeyPath(path, k)
+		keys[keyPath] = false
+		if child, ok := val.(map[interface{}]interface{}); ok {
+			collectKeys(child, keyPath, keys)
+		}
+	}
+}
+
+// isKnownKey reports whether a key, or one of the keys below it, is known.
+// Environment and component overrides of known keys are known too
+func isKnownKey(key string, known map[string]bool) bool {
+	key = stripOverlay(key)
+	root := strings.SplitN(key, ":", 2)[0]
+	if reservedKeys[root] || builtinFlags[key] {
+		return true
+	}
+	for k, open := range known {
+		k = stripOverlay(k)
+		if k == key || strings.HasPrefix(k, key+":") {
+			return true
+		}
+		if open && strings.HasPrefix(key, k+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// stripOverlay removes an environment or component prefix from a key, e.g.
+// component:api:environment:prod:server:port becomes server:port
+func stripOverlay(key string) string {
+	nodes := strings.Split(key, ":")
+	if len(nodes) > 2 && nodes[0] == "component" {
+		nodes = nodes[2:]
+	}
+	if len(nodes) > 2 && nodes[0] == "environment" {
+		nodes = nodes[2:]
+	}
+	return strings.Join(nodes, ":")
+}
+
+// checkUnknownKeys looks for flags and env variables that don't match a
+// known key. It returns an error under FailUnknownKeys, and records
+// warnings under WarnUnknownKeys
+func checkUnknownKeys(known map[string]bool) error {
+
+	if UnknownKeys == IgnoreUnknownKeys || len(Options()) == 0 {
+		return nil
+	}
+
+	// suggest keys as flags and env variables would set them
+	unique := make(map[string]bool)
+	for k := range known {
+		k = stripOverlay(k)
+		if !reservedKeys[strings.SplitN(k, ":", 2)[0]] {
+			unique[k] = true
+		}
+	}
+	var candidates []string
+	for k := range unique {
+		candidates = append(candidates, k)
+	}
+
+	var unknown Errors
+
+	for _, pair := range os.Environ() {
+		name := strings.SplitN(pair, "=", 2)[0]
+		if reservedEnvVars[name] {
+			continue
+		}
+		key, precedence, _ := envVarKey(name)
+		if precedence < 0 {
+			continue
+		}
+		if isKnownKey(key, known) {
+			continue
+		}
+		err := &UnknownKeyError{Name: name, Key: key}
+		if suggestion := closest(key, candidates); suggestion != "" {
+			err.Suggestion = envVarName(suggestion)
+		}
+		unknown = append(unknown, err)
+	}
+
+	for _, pair := range parseCommandLineArgs() {
+		stripped, _ := stripConfigPrefix(pair.Key)
+		key := optionForFlag(normalizeKey(stripped))
+		if isKnownKey(key, known) {
+			continue
+		}
+		err := &UnknownKeyError{Name: "--" + pair.Key, Key: key}
+		if len(pair.Key) == 1 {
+			err.Name = "-" + pair.Key
+		}
+		if suggestion := closest(key, candidates); suggestion != "" {
+			err.Suggestion = "--" + suggestion
+		}
+		unknown = append(unknown, err)
+	}
+
+	if len(unknown) == 0 {
+		return nil
+	}
+	if UnknownKeys == FailUnknownKeys {
+		return unknown
+	}
+	for _, err := range unknown {
+		addWarning(err)
+	}
+	return nil
+}
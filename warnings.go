@@ -0,0 +1,44 @@
+package config
+
+import (
+	"strings"
+	"sync"
+)
+
+var (
+	warnings      []error
+	warningsMutex = &sync.Mutex{}
+)
+
+// Warnings returns the non-fatal problems found during the last Load,
+// e.g. a remote source that was served from the local cache
+func Warnings() []error {
+	warningsMutex.Lock()
+	defer warningsMutex.Unlock()
+	return append([]error(nil), warnings...)
+}
+
+// addWarning records a non-fatal problem
+func addWarning(err error) {
+	warningsMutex.Lock()
+	warnings = append(warnings, err)
+	warningsMutex.Unlock()
+}
+
+// clearWarnings forgets all previously recorded problems
+func clearWarnings() {
+	warningsMutex.Lock()
+	warnings = nil
+	warningsMutex.Unlock()
+}
+
+// Errors collects several problems into a single error
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
@@ -0,0 +1,643 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// DuplicateKeyError is recorded as a warning when a mapping defines the
+// same key more than once. The last definition wins
+type DuplicateKeyError struct {
+	Key    string
+	First  Position
+	Second Position
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("%s: duplicate key %q, first defined at %s", e.Second, e.Key, e.First)
+}
+
+// CaseCollisionError is recorded when a mapping defines keys that only
+// differ by case, e.g. `Port` and `port`. Since keys are read
+// case-insensitively, only the lower-cased one can be read back
+type CaseCollisionError struct {
+	Key       string
+	FirstKey  string
+	SecondKey string
+	First     Position
+	Second    Position
+}
+
+func (e *CaseCollisionError) Error() string {
+	return fmt.Sprintf(
+		"%s: key %q collides with %q defined at %s",
+		e.Second, e.SecondKey, e.FirstKey, e.First,
+	)
+}
+
+// StrictKeys makes YAML loading lower-case every key, and fail on
+// duplicate or case-colliding keys instead of warning about them
+var StrictKeys = false
+
+// loadYAML converts the provided data to YAML and loads it into our
+// global config. This can be called multiple times, each time will
+// merge over previous values. The source names where the data came
+// from, and is used to record the position of every key
+func loadYAML(source string, data []byte) error {
+	return loadYAMLContext(context.Background(), source, data)
+}
+
+// loadYAMLContext loads YAML like loadYAML, fetching documents pulled in
+// with !include until the context is done
+func loadYAMLContext(ctx context.Context, source string, data []byte) error {
+
+	p := &yamlParser{
+		ctx:       ctx,
+		source:    source,
+		strict:    StrictKeys,
+		positions: make(map[string]Position),
+	}
+
+	value, err := p.stream(data, "")
+	if err != nil {
+		return err
+	}
+	if len(p.problems) > 0 {
+		return p.problems
+	}
+	var values map[interface{}]interface{}
+	if value != nil {
+		var ok bool
+		if values, ok = value.(map[interface{}]interface{}); !ok {
+			return fmt.Errorf("%s: config document must be a mapping", source)
+		}
+	}
+	for _, overlay := range p.overlays {
+		values = merge(overlay, values).(map[interface{}]interface{})
+	}
+
+	for key, val := range values {
+		keyPath := strings.ToLower(fmt.Sprint(key))
+		clearPositions(keyPath)
+		configMutex.Lock()
+		config[key] = val
+		configMutex.Unlock()
+	}
+	for keyPath, pos := range p.positions {
+		// keys replaced by a later document have no position
+		if hasKeyPath(values, keyPath) {
+			setPosition(keyPath, pos)
+		}
+	}
+	for _, keyPath := range p.sensitive {
+		if keyPath != "" {
+			MarkSensitive(keyPath)
+		}
+	}
+
+	return nil
+}
+
+// stream converts every document of a YAML stream, merging them in
+// order. Documents after the first may start with a header, see
+// documentHeader; they are kept in overlays, at path within their
+// environment or component
+func (p *yamlParser) stream(data []byte, path string) (interface{}, error) {
+
+	var value interface{}
+	decoder := yamlv3.NewDecoder(bytes.NewReader(data))
+	for i := 0; ; i++ {
+		var root yamlv3.Node
+		err := decoder.Decode(&root)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p.source, err)
+		}
+
+		// empty documents don't change anything
+		if root.Kind == 0 || len(root.Content) == 0 {
+			continue
+		}
+
+		body := root.Content[0]
+		var prefix []string
+		if i > 0 {
+			if prefix, body, err = p.documentHeader(body); err != nil {
+				return nil, err
+			}
+		}
+		if len(prefix) == 0 {
+			doc, err := p.convert(body, path)
+			if err != nil {
+				return nil, err
+			}
+			if doc != nil {
+				value = merge(doc, value)
+			}
+			continue
+		}
+
+		keyPath := append(prefix, nodes(path)...)
+		if path == "" {
+			keyPath = prefix
+		}
+		doc, err := p.convert(body, strings.Join(keyPath, ":"))
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			continue
+		}
+		for j := len(keyPath) - 1; j >= 0; j-- {
+			doc = map[interface{}]interface{}{keyPath[j]: doc}
+		}
+		p.overlays = append(p.overlays, doc.(map[interface{}]interface{}))
+	}
+	return value, nil
+}
+
+// documentHeader reads the header of a document in a stream, that limits
+// it to an environment or component:
+//
+//	when:
+//	  environment: prod
+//	  component: api
+//
+// or just `environment: prod`. It returns the overlay the document is
+// loaded into, e.g. environment, prod, and the document without header
+func (p *yamlParser) documentHeader(node *yamlv3.Node) ([]string, *yamlv3.Node, error) {
+
+	if node.Kind != yamlv3.MappingNode {
+		return nil, node, nil
+	}
+
+	var env, comp string
+	body := *node
+	body.Content = nil
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valNode := node.Content[i], node.Content[i+1]
+		switch {
+		case keyNode.Value == "environment" && valNode.Kind == yamlv3.ScalarNode:
+			env = valNode.Value
+		case keyNode.Value == "when":
+			if valNode.Kind != yamlv3.MappingNode {
+				return nil, nil, fmt.Errorf("%s: when must be a mapping of environment and component", p.position(valNode))
+			}
+			for j := 0; j+1 < len(valNode.Content); j += 2 {
+				condition, value := valNode.Content[j], valNode.Content[j+1]
+				switch {
+				case condition.Value == "environment" && value.Kind == yamlv3.ScalarNode:
+					env = value.Value
+				case condition.Value == "component" && value.Kind == yamlv3.ScalarNode:
+					comp = value.Value
+				default:
+					return nil, nil, fmt.Errorf("%s: when must be a mapping of environment and component", p.position(condition))
+				}
+			}
+		default:
+			body.Content = append(body.Content, keyNode, valNode)
+		}
+	}
+
+	var prefix []string
+	if comp != "" {
+		prefix = append(prefix, "component", comp)
+	}
+	if env != "" {
+		prefix = append(prefix, "environment", env)
+	}
+	return prefix, &body, nil
+}
+
+// hasKeyPath reports whether a key path, as recorded with positions,
+// leads to a value in a tree of maps
+func hasKeyPath(values map[interface{}]interface{}, keyPath string) bool {
+	var node interface{} = values
+	for _, part := range strings.Split(keyPath, ":") {
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return false
+		}
+		found := false
+		for k, v := range m {
+			if strings.ToLower(fmt.Sprint(k)) == part {
+				node, found = v, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// yamlParser turns a YAML node tree into the map[interface{}]interface{}
+// tree used by config, remembering where each key was defined
+type yamlParser struct {
+	ctx       context.Context
+	source    string
+	strict    bool
+	positions map[string]Position
+	problems  Errors
+	// sensitive are the keys of values tagged !secret
+	sensitive []string
+	// lists counts the lists being converted
+	lists int
+	// dataKey decrypts ENC[...] values, and is read on first use
+	dataKey []byte
+	// includes are the sources including the one being converted
+	includes []string
+	// overlays are the documents of streams with a header, see stream
+	overlays []map[interface{}]interface{}
+	// aliases counts the aliases being expanded, and aliasNodes the nodes
+	// converted while expanding them
+	aliases, aliasNodes int
+}
+
+// maxAliasNodes is the most nodes aliases of a document may expand to
+const maxAliasNodes = 1 << 20
+
+// keyProblem reports a duplicate or colliding key. Strict parsers fail
+// with it, others warn
+func (p *yamlParser) keyProblem(err error) {
+	if p.strict {
+		p.problems = append(p.problems, err)
+		return
+	}
+	addWarning(err)
+}
+
+// definedKey is a key as it was written in a mapping
+type definedKey struct {
+	raw string
+	pos Position
+}
+
+func (p *yamlParser) position(node *yamlv3.Node) Position {
+	return Position{Source: p.source, Line: node.Line, Column: node.Column}
+}
+
+// convert returns the value of a node. path is the key path of the node,
+// and is used to record positions
+func (p *yamlParser) convert(node *yamlv3.Node, path string) (interface{}, error) {
+
+	// aliases are expanded by converting their anchor again, so bound the
+	// work documents like "billion laughs" can cause
+	if p.aliases > 0 {
+		p.aliasNodes++
+		if p.aliasNodes > maxAliasNodes {
+			return nil, fmt.Errorf("%s: aliases expand to more than %d nodes", p.position(node), maxAliasNodes)
+		}
+	}
+
+	switch node.Kind {
+
+	case yamlv3.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return p.convert(node.Content[0], path)
+
+	case yamlv3.AliasNode:
+		p.aliases++
+		defer func() { p.aliases-- }()
+		return p.convert(node.Alias, path)
+
+	case yamlv3.ScalarNode:
+		if (node.Tag == "!!str" || node.Tag == "!secret") && isEncryptedValue(node.Value) {
+			return p.decrypt(node, path)
+		}
+		switch node.Tag {
+		case "!secret":
+			p.sensitive = append(p.sensitive, path)
+			return node.Value, nil
+		case "!include":
+			return p.include(node, path)
+		case "!env":
+			if LoaderType(p.source) != "file" {
+				return nil, fmt.Errorf("%s: %s: remote documents cannot read env variables", p.position(node), path)
+			}
+			return os.Getenv(node.Value), nil
+		case "!file":
+			val, err := p.readFile(node.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", p.position(node), path, err)
+			}
+			return val, nil
+		}
+		if b, ok := yaml11Bools[node.Value]; ok && node.Tag == "!!str" && node.Style == 0 {
+			return b, nil
+		}
+		return p.scalar(node)
+
+	case yamlv3.SequenceNode:
+		// items share the key of the list, e.g. a !secret item makes the
+		// list sensitive, but keys in items have no position of their own
+		list := make([]interface{}, 0, len(node.Content))
+		p.lists++
+		defer func() { p.lists-- }()
+		for _, item := range node.Content {
+			val, err := p.convert(item, path)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, val)
+		}
+		return list, nil
+
+	case yamlv3.MappingNode:
+		return p.mapping(node, path)
+
+	}
+
+	return nil, fmt.Errorf("%s: unsupported YAML node", p.position(node))
+}
+
+// decrypt decrypts an ENC[...] value, and marks its key as sensitive
+func (p *yamlParser) decrypt(node *yamlv3.Node, path string) (interface{}, error) {
+	if p.dataKey == nil {
+		key, err := dataKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", p.position(node), path, err)
+		}
+		p.dataKey = key
+	}
+	val, err := decryptValue(path, node.Value, p.dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %v", p.position(node), path, err)
+	}
+	p.sensitive = append(p.sensitive, path)
+	return val, nil
+}
+
+// include converts the document of an !include tag in place of the node.
+// Paths are relative to the including document, and may be any config URI
+func (p *yamlParser) include(node *yamlv3.Node, path string) (interface{}, error) {
+
+	target, err := p.resolve(node.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p.position(node), err)
+	}
+	stack := append(append([]string{}, p.includes...), p.source)
+	for i, source := range stack {
+		if sameSource(source, target) {
+			cycle := append(stack[i:], target)
+			return nil, fmt.Errorf("%s: include cycle %s", p.position(node), strings.Join(cycle, " -> "))
+		}
+	}
+
+	data, err := loadInclude(p.ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("%s: include %s: %v", p.position(node), target, err)
+	}
+
+	p.includes = stack
+	p.source = target
+	defer func() {
+		p.source = stack[len(stack)-1]
+		p.includes = stack[:len(stack)-1]
+	}()
+	return p.stream(data, path)
+}
+
+// readFile reads the document of a !file tag, without its trailing newline
+func (p *yamlParser) readFile(ref string) (string, error) {
+	target, err := p.resolve(ref)
+	if err != nil {
+		return "", err
+	}
+	var data []byte
+	if LoaderType(target) == "file" {
+		data, err = ioutil.ReadFile(target)
+	} else {
+		data, err = loadInclude(p.ctx, target)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r"), nil
+}
+
+// resolve resolves a reference relative to the document being converted.
+// Remote documents may only reference remote documents, so that a signed
+// document cannot pull in unverified local files
+func (p *yamlParser) resolve(ref string) (string, error) {
+	target := includeURI(p.source, ref)
+	if LoaderType(p.source) != "file" && LoaderType(target) == "file" {
+		return "", fmt.Errorf("remote documents cannot read local file %s", ref)
+	}
+	return target, nil
+}
+
+// loadInclude fetches and decrypts an included document the way config
+// sources are loaded
+func loadInclude(ctx context.Context, uri string) ([]byte, error) {
+	loader, err := loaderForURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fetch(ctx, uri, loader)
+	if err != nil {
+		return nil, err
+	}
+	source, _, _ := splitURIParams(uri)
+	return decryptDocument(source, data)
+}
+
+// includeURI resolves a reference relative to the document including it,
+// e.g. shared/db.yaml included from s3://us-west-2/bucket/app.yaml is
+// s3://us-west-2/bucket/shared/db.yaml
+func includeURI(base, ref string) string {
+	if LoaderType(ref) != "file" || filepath.IsAbs(ref) {
+		return ref
+	}
+	switch LoaderType(base) {
+	case "http":
+		baseURL, err := url.Parse(base)
+		if err != nil {
+			return ref
+		}
+		refURL, err := url.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return baseURL.ResolveReference(refURL).String()
+	case "s3":
+		return s3URIPrefix + path.Join(path.Dir(strings.TrimPrefix(base, s3URIPrefix)), ref)
+	}
+	return localPath(base, ref)
+}
+
+// sameSource reports whether two config URIs name the same document
+func sameSource(a, b string) bool {
+	if LoaderType(a) == "file" && LoaderType(b) == "file" {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return a == b
+}
+
+// localPath resolves a file path relative to the directory of a local
+// document
+func localPath(base, ref string) string {
+	if filepath.IsAbs(ref) {
+		return ref
+	}
+	return filepath.Join(filepath.Dir(base), ref)
+}
+
+// yaml11Bools are the YAML 1.1 spellings of bools that YAML 1.2 reads as
+// strings. Configs were read as YAML 1.1 before, so plain values like
+// `enabled: yes` stay bools. Keys are kept as strings
+var yaml11Bools = map[string]bool{
+	"y": true, "Y": true, "yes": true, "Yes": true, "YES": true,
+	"on": true, "On": true, "ON": true,
+	"n": false, "N": false, "no": false, "No": false, "NO": false,
+	"off": false, "Off": false, "OFF": false,
+}
+
+// scalar decodes a scalar node. Timestamps are kept as strings, like the
+// rest of config expects
+func (p *yamlParser) scalar(node *yamlv3.Node) (interface{}, error) {
+	if node.Tag == "!!timestamp" {
+		return node.Value, nil
+	}
+	var val interface{}
+	if err := node.Decode(&val); err != nil {
+		return nil, fmt.Errorf("%s: %v", p.position(node), err)
+	}
+	return val, nil
+}
+
+// mapping converts a mapping node. Values pulled in with merge keys (<<)
+// never override keys that are defined in the mapping itself, and earlier
+// merges win over later ones
+func (p *yamlParser) mapping(node *yamlv3.Node, path string) (interface{}, error) {
+
+	values := make(map[interface{}]interface{})
+	seen := make(map[string]definedKey)
+
+	// merged keys go in first, so that the mapping's own keys replace them
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Tag == "!!merge" {
+			if err := p.merge(values, node.Content[i+1], path); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valNode := node.Content[i], node.Content[i+1]
+		if keyNode.Tag == "!!merge" {
+			continue
+		}
+
+		key, err := p.scalar(keyNode)
+		if err != nil {
+			return nil, err
+		}
+		if !hashable(key) {
+			return nil, fmt.Errorf("%s: invalid map key", p.position(keyNode))
+		}
+
+		// keys are read case-insensitively, so catch keys that can
+		// never be read back
+		keyPath := joinKeyPath(path, key)
+		pos := p.position(keyNode)
+		raw := fmt.Sprint(key)
+		if first, ok := seen[keyPath]; ok {
+			if first.raw == raw {
+				p.keyProblem(&DuplicateKeyError{Key: keyPath, First: first.pos, Second: pos})
+			} else {
+				p.keyProblem(&CaseCollisionError{
+					Key:       keyPath,
+					FirstKey:  first.raw,
+					SecondKey: raw,
+					First:     first.pos,
+					Second:    pos,
+				})
+			}
+		}
+		seen[keyPath] = definedKey{raw: raw, pos: pos}
+
+		if s, ok := key.(string); ok && p.strict {
+			key = strings.ToLower(s)
+		}
+
+		val, err := p.convert(valNode, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = val
+		if p.lists == 0 {
+			p.positions[keyPath] = pos
+		}
+	}
+
+	return values, nil
+}
+
+// merge copies the keys of a merge key value (a mapping, or a list of
+// mappings) into values, without overriding existing keys
+func (p *yamlParser) merge(values map[interface{}]interface{}, node *yamlv3.Node, path string) error {
+
+	if node.Kind == yamlv3.AliasNode {
+		p.aliases++
+		defer func() { p.aliases-- }()
+		node = node.Alias
+	}
+
+	if node.Kind == yamlv3.SequenceNode {
+		for _, item := range node.Content {
+			if err := p.merge(values, item, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if node.Kind != yamlv3.MappingNode {
+		return fmt.Errorf("%s: merge key value must be a mapping", p.position(node))
+	}
+
+	merged, err := p.mapping(node, path)
+	if err != nil {
+		return err
+	}
+	for key, val := range merged.(map[interface{}]interface{}) {
+		if _, ok := values[key]; !ok {
+			values[key] = val
+		}
+	}
+	return nil
+}
+
+// joinKeyPath appends a key to a ":" separated key path
+func joinKeyPath(path string, key interface{}) string {
+	k := strings.ToLower(fmt.Sprint(key))
+	if path == "" {
+		return k
+	}
+	return path + ":" + k
+}
+
+// hashable reports whether a value can be used as a map key
+func hashable(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+		return false
+	}
+	return true
+}